@@ -26,11 +26,22 @@ type Block struct {
 	*Container
 	Order int
 	Keys  []string
+	// Sources describes where the block was defined, like "container web" or
+	// "file /etc/caddy/Caddyfile". Merged blocks keep the sources of all of them.
+	Sources []string
+	// Comments preceding the block, or following it on the same line, in caddyfile
+	// format like "# comment"
+	Comments []string
+	// rawPosition orders blocks grafted from raw labels with the same Order, by
+	// the label isolation suffix and then the position in the fragment
+	rawPosition []int
 }
 
 // Container represents a collection of blocks
 type Container struct {
 	Children []*Block
+	// TrailingComments follow the last block of the container
+	TrailingComments []string
 }
 
 // CreateBlock creates a block
@@ -54,6 +65,55 @@ func (block *Block) AddKeys(keys ...string) {
 	block.Keys = append(block.Keys, keys...)
 }
 
+// AddSources to block, ignoring sources it already has
+func (block *Block) AddSources(sources ...string) {
+	for _, source := range sources {
+		if !containsString(block.Sources, source) {
+			block.Sources = append(block.Sources, source)
+		}
+	}
+}
+
+// AddComments to block
+func (block *Block) AddComments(comments ...string) {
+	block.Comments = append(block.Comments, comments...)
+}
+
+// MergeComments from another block, ignoring comments the block already has
+func (block *Block) MergeComments(comments ...string) {
+	block.Comments = appendMissing(block.Comments, comments)
+}
+
+// AddTrailingComments to container
+func (container *Container) AddTrailingComments(comments ...string) {
+	container.TrailingComments = append(container.TrailingComments, comments...)
+}
+
+// MergeTrailingComments from another container, ignoring comments the container
+// already has
+func (container *Container) MergeTrailingComments(comments ...string) {
+	container.TrailingComments = appendMissing(container.TrailingComments, comments)
+}
+
+// appendMissing appends the values not in existing, keeping repeated values
+func appendMissing(existing []string, values []string) []string {
+	result := existing
+	for _, value := range values {
+		if !containsString(existing, value) {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// SetSource adds a source to all blocks of the container, recursively
+func (container *Container) SetSource(source string) {
+	for _, block := range container.Children {
+		block.AddSources(source)
+		block.Container.SetSource(source)
+	}
+}
+
 // AddBlock to container
 func (container *Container) AddBlock(block *Block) {
 	container.Children = append(container.Children, block)
@@ -99,7 +159,21 @@ func (block *Block) IsSnippet() bool {
 	return len(block.Keys) == 1 && strings.HasPrefix(block.Keys[0], "(") && strings.HasSuffix(block.Keys[0], ")")
 }
 
+// IsNamedRoute returns if block is a named route
+func (block *Block) IsNamedRoute() bool {
+	return len(block.Keys) == 1 && strings.HasPrefix(block.Keys[0], "&(") && strings.HasSuffix(block.Keys[0], ")")
+}
+
 // IsMatcher returns if block is a matcher
 func (block *Block) IsMatcher() bool {
 	return len(block.Keys) > 0 && strings.HasPrefix(block.Keys[0], "@")
 }
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -2,8 +2,10 @@ package caddyfile
 
 import (
 	"bytes"
+	"fmt"
 	"math"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
@@ -14,20 +16,63 @@ var labelParserRegex = regexp.MustCompile(`^(?:(.+)\.)?(?:(\d+)_)?([^.]+?)(?:_(\
 
 const escapedDotPlaceholder = "\x00"
 
-// FromLabels converts key value labels into a caddyfile
+// rawLabelName is the name of labels whose value is a caddyfile fragment
+const rawLabelName = "raw"
+
+// LabelError is an error converting a label into a caddyfile
+type LabelError struct {
+	// Label is the full label key
+	Label string
+	// Source describes where the label is defined, like "container web"
+	Source string
+	Err    error
+}
+
+func (e *LabelError) Error() string {
+	if e.Source != "" {
+		return fmt.Sprintf("%s on %s: %s", e.Label, e.Source, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Label, e.Err)
+}
+
+func (e *LabelError) Unwrap() error {
+	return e.Err
+}
+
+// FromLabels converts key value labels into a caddyfile.
+// Errors are returned as *LabelError.
 func FromLabels(labels map[string]string, templateData interface{}, templateFuncs template.FuncMap) (*Container, error) {
 	container := CreateContainer()
 
+	keys := make([]string, 0, len(labels))
+	for label := range labels {
+		keys = append(keys, label)
+	}
+	sort.Strings(keys)
+
 	blocksByPath := map[string]*Block{}
-	for label, value := range labels {
-		block := getOrCreateBlock(container, label, blocksByPath)
-		argsText, err := processVariables(templateData, templateFuncs, value)
+	for _, label := range keys {
+		argsText, err := processVariables(templateData, templateFuncs, labels[label])
 		if err != nil {
-			return nil, err
+			return nil, &LabelError{Label: label, Err: err}
+		}
+		if parentPath, order, isolation, isRaw := parseRawLabel(label); isRaw {
+			raw, err := Unmarshal([]byte(argsText))
+			if err != nil {
+				return nil, &LabelError{Label: label, Err: err}
+			}
+			parentBlock := getOrCreateBlock(container, parentPath, blocksByPath)
+			for index, block := range raw.Children {
+				block.Order = order
+				block.rawPosition = []int{isolation, index}
+				parentBlock.AddBlock(block)
+			}
+			continue
 		}
+		block := getOrCreateBlock(container, label, blocksByPath)
 		args, err := parseArgs(argsText)
 		if err != nil {
-			return nil, err
+			return nil, &LabelError{Label: label, Err: err}
 		}
 		block.AddKeys(args...)
 	}
@@ -60,6 +105,19 @@ func getOrCreateBlock(container *Container, path string, blocksByPath map[string
 	return block
 }
 
+// parseRawLabel returns the path of the block a raw label is grafted into, its
+// order prefix and isolation suffix, and whether the label is a raw label, like
+// caddy.raw or caddy.handle.1_raw_2
+func parseRawLabel(label string) (string, int, int, bool) {
+	path := strings.ReplaceAll(label, `\.`, escapedDotPlaceholder)
+	parentPath, order, name := parsePath(path)
+	if name != rawLabelName || parentPath == "" {
+		return "", 0, 0, false
+	}
+	isolation, _ := strconv.Atoi(labelParserRegex.FindStringSubmatch(path)[4])
+	return strings.ReplaceAll(parentPath, escapedDotPlaceholder, `\.`), order, isolation, true
+}
+
 func parsePath(path string) (string, int, string) {
 	match := labelParserRegex.FindStringSubmatch(path)
 	parentPath := match[1]
@@ -94,7 +152,14 @@ func parseArgs(text string) ([]string, error) {
 		return nil, err
 	}
 	var args []string
-	for l.next() {
+	for {
+		found, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			break
+		}
 		args = append(args, l.token.Text)
 	}
 	return args, nil
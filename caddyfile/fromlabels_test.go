@@ -107,3 +107,23 @@ func parseLabelsFromString(s string) (map[string]string, error) {
 
 	return labels, nil
 }
+
+func TestFromLabels_WrapsErrorsWithLabel(t *testing.T) {
+	_, err := FromLabels(map[string]string{
+		"caddy":               "example.com",
+		"caddy.reverse_proxy": "{{invalid}}",
+	}, nil, template.FuncMap{})
+
+	var labelErr *LabelError
+	assert.ErrorAs(t, err, &labelErr)
+	assert.Equal(t, "caddy.reverse_proxy", labelErr.Label)
+	assert.EqualError(t, err, `caddy.reverse_proxy: template: :1: function "invalid" not defined`)
+
+	labelErr.Source = "container web-1"
+	assert.EqualError(t, err, `caddy.reverse_proxy on container web-1: template: :1: function "invalid" not defined`)
+
+	_, err = FromLabels(map[string]string{
+		"caddy.respond": "<<EOF\ntext",
+	}, nil, template.FuncMap{})
+	assert.EqualError(t, err, "caddy.respond: incomplete heredoc <<EOF on line #2, expected ending marker EOF")
+}
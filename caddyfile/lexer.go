@@ -16,7 +16,10 @@ package caddyfile
 
 import (
 	"bufio"
+	"fmt"
 	"io"
+	"regexp"
+	"strings"
 	"unicode"
 )
 
@@ -29,14 +32,26 @@ type (
 		reader       *bufio.Reader
 		token        Token
 		line         int
+		column       int
 		skippedLines int
+		// comments read since the last token
+		comments []commentLine
 	}
 
 	// Token represents a single parsable unit.
 	Token struct {
-		File string
-		Line int
-		Text string
+		File      string
+		Line      int
+		Column    int
+		Text      string
+		wasQuoted rune // enclosing quote character, if any
+		comments  []commentLine
+	}
+
+	// commentLine is a comment preceding a token
+	commentLine struct {
+		text string
+		line int
 	}
 )
 
@@ -45,6 +60,7 @@ type (
 func (l *lexer) load(input io.Reader) error {
 	l.reader = bufio.NewReader(input)
 	l.line = 1
+	l.column = 0
 
 	// discard byte order mark, if present
 	firstCh, _, err := l.reader.ReadRune()
@@ -68,28 +84,109 @@ func (l *lexer) load(input io.Reader) error {
 // quotes (the enclosing quotes are not included).
 // Inside quoted strings, quotes may be escaped
 // with a preceding \ character. No other chars
-// may be escaped. The rest of the line is skipped
+// may be escaped. A token starting with <<MARKER
+// followed by a line break is a heredoc, and goes
+// until MARKER. The rest of the line is skipped
 // if a "#" character is read in. Returns true if
 // a token was loaded; false otherwise.
-func (l *lexer) next() bool {
-	var val []rune
-	var comment, quoted, btQuoted, escaped bool
+func (l *lexer) next() (bool, error) {
+	var val, commentVal []rune
+	var comment, quoted, btQuoted, inHeredoc, heredocEscaped, escaped bool
+	var heredocMarker string
 
-	makeToken := func() bool {
+	endComment := func() {
+		if comment {
+			l.comments = append(l.comments, commentLine{
+				text: strings.TrimRightFunc(string(commentVal), unicode.IsSpace),
+				line: l.line,
+			})
+			comment = false
+			commentVal = nil
+		}
+	}
+
+	makeToken := func(quoted rune) bool {
 		l.token.Text = string(val)
+		l.token.wasQuoted = quoted
 		return true
 	}
 
 	for {
 		ch, _, err := l.reader.ReadRune()
+		if ch == '\n' {
+			l.column = 0
+		} else if err == nil {
+			l.column++
+		}
 		if err != nil {
+			endComment()
 			if len(val) > 0 {
-				return makeToken()
+				if inHeredoc {
+					return false, fmt.Errorf("incomplete heredoc <<%s on line #%d, expected ending marker %s", heredocMarker, l.line+l.skippedLines, heredocMarker)
+				}
+				return makeToken(0), nil
 			}
 			if err == io.EOF {
-				return false
+				return false, nil
+			}
+			return false, err
+		}
+
+		// detect whether we have the start of a heredoc
+		if !quoted && !btQuoted && !inHeredoc && !heredocEscaped &&
+			len(val) > 1 && string(val[:2]) == "<<" {
+			// a space means it's just a regular token and not a heredoc
+			if ch == ' ' {
+				return makeToken(0), nil
+			}
+			if ch == '\r' {
+				continue
+			}
+			// the heredoc marker is what follows << until the line break
+			if ch == '\n' {
+				if len(val) == 2 {
+					return false, fmt.Errorf("missing opening heredoc marker on line #%d", l.line)
+				}
+				if string(val[:3]) == "<<<" {
+					return false, fmt.Errorf("too many '<' for heredoc on line #%d; only use two, for example <<END", l.line)
+				}
+				heredocMarker = string(val[2:])
+				if !heredocMarkerRegexp.MatchString(heredocMarker) {
+					return false, fmt.Errorf("heredoc marker on line #%d must contain only alphanumeric characters, dashes and underscores; got '%s'", l.line, heredocMarker)
+				}
+				inHeredoc = true
+				l.skippedLines++
+				val = nil
+				continue
+			}
+			val = append(val, ch)
+			continue
+		}
+
+		// inside a heredoc, all characters are read as-is until the marker
+		if inHeredoc {
+			val = append(val, ch)
+			if ch == '\n' {
+				l.skippedLines++
+			}
+			if len(val) >= len(heredocMarker) && heredocMarker == string(val[len(val)-len(heredocMarker):]) {
+				val, err = l.finalizeHeredoc(val, heredocMarker)
+				if err != nil {
+					return false, err
+				}
+				l.line += l.skippedLines
+				l.skippedLines = 0
+				return makeToken('<'), nil
 			}
-			panic(err)
+			continue
+		}
+
+		// comments are kept as-is until the end of the line
+		if comment && ch != '\n' {
+			if ch != '\r' {
+				commentVal = append(commentVal, ch)
+			}
+			continue
 		}
 
 		if !escaped && !btQuoted && ch == '\\' {
@@ -107,10 +204,10 @@ func (l *lexer) next() bool {
 				escaped = false
 			} else {
 				if quoted && ch == '"' {
-					return makeToken()
+					return makeToken(ch), nil
 				}
 				if btQuoted && ch == '`' {
-					return makeToken()
+					return makeToken(ch), nil
 				}
 			}
 			if ch == '\n' {
@@ -126,6 +223,7 @@ func (l *lexer) next() bool {
 				continue
 			}
 			if ch == '\n' {
+				endComment()
 				if escaped {
 					l.skippedLines++
 					escaped = false
@@ -133,23 +231,22 @@ func (l *lexer) next() bool {
 					l.line += 1 + l.skippedLines
 					l.skippedLines = 0
 				}
-				comment = false
 			}
 			if len(val) > 0 {
-				return makeToken()
+				return makeToken(0), nil
 			}
 			continue
 		}
 
 		if ch == '#' && len(val) == 0 {
 			comment = true
-		}
-		if comment {
+			commentVal = append(commentVal, ch)
 			continue
 		}
 
 		if len(val) == 0 {
-			l.token = Token{Line: l.line}
+			l.token = Token{Line: l.line, Column: l.column, comments: l.comments}
+			l.comments = nil
 			if ch == '"' {
 				quoted = true
 				continue
@@ -161,10 +258,55 @@ func (l *lexer) next() bool {
 		}
 
 		if escaped {
-			val = append(val, '\\')
+			// allow escaping the first < to skip the heredoc syntax
+			if ch == '<' {
+				heredocEscaped = true
+			} else {
+				val = append(val, '\\')
+			}
 			escaped = false
 		}
 
 		val = append(val, ch)
 	}
 }
+
+// finalizeHeredoc strips from every line of the heredoc the whitespace
+// preceding its closing marker, and removes the marker
+func (l *lexer) finalizeHeredoc(val []rune, marker string) ([]rune, error) {
+	stringVal := string(val)
+
+	// the contents end at the last line break, before the marker
+	lastNewline := strings.LastIndex(stringVal, "\n")
+	lines := strings.Split(stringVal[:lastNewline+1], "\n")
+	paddingToStrip := stringVal[lastNewline+1 : len(stringVal)-len(marker)]
+
+	var out strings.Builder
+	for lineNum, lineText := range lines[:len(lines)-1] {
+		if lineText == "" || lineText == "\r" {
+			out.WriteString("\n")
+			continue
+		}
+		if !strings.HasPrefix(lineText, paddingToStrip) {
+			return nil, fmt.Errorf("mismatched leading whitespace in heredoc <<%s on line #%d [%s], expected whitespace [%s] to match the closing marker",
+				marker, l.line+lineNum+1, strings.TrimRight(lineText, "\r\n"), paddingToStrip)
+		}
+		out.WriteString(strings.ReplaceAll(lineText[len(paddingToStrip):]+"\n", "\r", ""))
+	}
+
+	return []rune(strings.TrimSuffix(out.String(), "\n")), nil
+}
+
+// NumLineBreaks counts how many line breaks the token spans
+func (t Token) NumLineBreaks() int {
+	lineBreaks := strings.Count(t.Text, "\n")
+	if t.wasQuoted == '<' {
+		// heredocs have an extra line break because the opening marker is on
+		// its own line, and another one because the closing marker is on the
+		// line after the text
+		lineBreaks += 2
+	}
+	return lineBreaks
+}
+
+var heredocMarkerRegexp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
@@ -3,6 +3,7 @@ package caddyfile
 import (
 	"bytes"
 	"fmt"
+	"slices"
 	"sort"
 	"strings"
 
@@ -13,7 +14,16 @@ import (
 func (container *Container) Marshal() []byte {
 	container.sort()
 	buffer := &bytes.Buffer{}
-	container.write(buffer, 0)
+	container.write(buffer, 0, nil)
+	return buffer.Bytes()
+}
+
+// MarshalWithSources marshals container into caddyfile bytes, with a comment
+// before each block listing its sources, when they differ from its parent ones
+func (container *Container) MarshalWithSources() []byte {
+	container.sort()
+	buffer := &bytes.Buffer{}
+	container.write(buffer, 0, []string{})
 	return buffer.Bytes()
 }
 
@@ -21,51 +31,112 @@ func (container *Container) Marshal() []byte {
 func (block *Block) Marshal() []byte {
 	block.Container.sort()
 	buffer := &bytes.Buffer{}
-	block.write(buffer, 0)
+	block.write(buffer, 0, nil)
+	return buffer.Bytes()
+}
+
+// MarshalWithSources marshals block into caddyfile bytes, with source comments
+func (block *Block) MarshalWithSources() []byte {
+	block.Container.sort()
+	buffer := &bytes.Buffer{}
+	block.write(buffer, 0, []string{})
 	return buffer.Bytes()
 }
 
-// write all blocks to a buffer
-func (container *Container) write(buffer *bytes.Buffer, level int) {
+// write all blocks to a buffer.
+// Sources are written as comments when parentSources isn't nil.
+func (container *Container) write(buffer *bytes.Buffer, level int, parentSources []string) {
 	for _, block := range container.Children {
-		block.write(buffer, level)
+		block.write(buffer, level, parentSources)
+	}
+	writeComments(buffer, container.TrailingComments, level)
+}
+
+func writeComments(buffer *bytes.Buffer, comments []string, level int) {
+	for _, comment := range comments {
+		buffer.WriteString(strings.Repeat("\t", level))
+		buffer.WriteString(comment + "\n")
 	}
 }
 
 // write block to a buffer
-func (block *Block) write(buffer *bytes.Buffer, level int) {
+func (block *Block) write(buffer *bytes.Buffer, level int, parentSources []string) {
+	var childrenParentSources []string
+	if parentSources != nil {
+		childrenParentSources = parentSources
+		if len(block.Sources) > 0 && !stringsAreEqual(block.Sources, parentSources) {
+			buffer.WriteString(strings.Repeat("\t", level))
+			buffer.WriteString("# source: " + strings.Join(block.Sources, ", ") + "\n")
+			childrenParentSources = block.Sources
+		}
+	}
+	writeComments(buffer, block.Comments, level)
+
 	buffer.WriteString(strings.Repeat("\t", level))
-	needsWhitespace := false
-	for _, key := range block.Keys {
-		if needsWhitespace {
+	writeKeys(buffer, block.Keys, level+1)
+	if len(block.Children) > 0 || len(block.TrailingComments) > 0 {
+		if len(block.Keys) > 0 {
 			buffer.WriteString(" ")
 		}
+		buffer.WriteString("{\n")
+		block.Container.write(buffer, level+1, childrenParentSources)
+		buffer.WriteString(strings.Repeat("\t", level) + "}")
+	}
+	buffer.WriteString("\n")
+}
 
-		if strings.ContainsAny(key, "\n\"") {
-			// If token has line break or quote, we use backtick for readability
+// writeKeys writes whitespace separated keys, quoting them when needed.
+// Heredocs are indented to level.
+func writeKeys(buffer *bytes.Buffer, keys []string, level int) {
+	for index, key := range keys {
+		if index > 0 {
+			buffer.WriteString(" ")
+		}
+
+		if strings.Contains(key, "\n") {
+			// If token has line break, we use a heredoc indented as children
+			writeHeredoc(buffer, key, level)
+		} else if strings.Contains(key, "\"") && !strings.Contains(key, "`") {
+			// If token has quote, we use backtick for readability
 			buffer.WriteString("`")
-			buffer.WriteString(strings.ReplaceAll(key, "`", "\\`"))
+			buffer.WriteString(key)
 			buffer.WriteString("`")
-		} else if strings.ContainsAny(key, ` `) {
+		} else if strings.ContainsAny(key, " \t\"`") {
 			// If token has whitespace, we use duoble quote
 			buffer.WriteString("\"")
 			buffer.WriteString(strings.ReplaceAll(key, "\"", "\\\""))
 			buffer.WriteString("\"")
+		} else if strings.HasPrefix(key, "<<") {
+			// Escape tokens that would start a heredoc
+			buffer.WriteString("\\")
+			buffer.WriteString(key)
 		} else {
 			buffer.WriteString(key)
 		}
+	}
+}
 
-		needsWhitespace = true
+// writeHeredoc writes a multi-line token as a heredoc, with a marker not found
+// in the token and every line indented to the level of the closing marker
+func writeHeredoc(buffer *bytes.Buffer, key string, level int) {
+	marker := "EOF"
+	for i := 1; strings.Contains(key, marker); i++ {
+		marker = fmt.Sprintf("EOF%d", i)
 	}
-	if len(block.Children) > 0 {
-		if needsWhitespace {
-			buffer.WriteString(" ")
+	indentation := strings.Repeat("\t", level)
+	buffer.WriteString("<<" + marker + "\n")
+	for _, line := range strings.Split(key, "\n") {
+		if line != "" {
+			buffer.WriteString(indentation + line)
 		}
-		buffer.WriteString("{\n")
-		block.Container.write(buffer, level+1)
-		buffer.WriteString(strings.Repeat("\t", level) + "}")
+		buffer.WriteString("\n")
 	}
-	buffer.WriteString("\n")
+	buffer.WriteString(indentation + marker)
+}
+
+// Sort container blocks recursively, in the order they are marshaled
+func (container *Container) Sort() {
+	container.sort()
 }
 
 func (container *Container) sort() {
@@ -109,6 +180,16 @@ func compareBlocks(blockA *Block, blockB *Block) int {
 		}
 		return 1
 	}
+	// Then blocks of raw labels, in the order they were written
+	if (blockA.rawPosition == nil) != (blockB.rawPosition == nil) {
+		if blockA.rawPosition != nil {
+			return -1
+		}
+		return 1
+	}
+	if comparison := slices.Compare(blockA.rawPosition, blockB.rawPosition); comparison != 0 {
+		return comparison
+	}
 	// Then compare common keys
 	for keyIndex := 0; keyIndex < min(len(blockA.Keys), len(blockB.Keys)); keyIndex++ {
 		if blockA.Keys[keyIndex] != blockB.Keys[keyIndex] {
@@ -143,6 +224,18 @@ func compareBlocks(blockA *Block, blockB *Block) int {
 	return 0
 }
 
+func stringsAreEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -152,37 +245,61 @@ func min(a, b int) int {
 
 // Unmarshal a Block fom caddyfile content
 func Unmarshal(caddyfileContent []byte) (*Container, error) {
-	tokens, err := allTokens("", caddyfileContent)
+	tokens, trailingComments, err := allTokens("", caddyfileContent)
 	if err != nil {
 		return nil, err
 	}
 
-	return parseContainer(tokens)
+	return parseContainer(tokens, trailingComments)
 }
 
-func allTokens(filename string, input []byte) ([]Token, error) {
+// allTokens returns all tokens of input, and the comments following the last one
+func allTokens(filename string, input []byte) ([]Token, []commentLine, error) {
 	l := new(lexer)
 	err := l.load(bytes.NewReader(input))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	var tokens []Token
-	for l.next() {
+	for {
+		found, err := l.next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !found {
+			break
+		}
 		l.token.File = filename
 		tokens = append(tokens, l.token)
 	}
-	return tokens, nil
+	return tokens, l.comments, nil
 }
 
-func parseContainer(tokens []Token) (*Container, error) {
+func parseContainer(tokens []Token, trailingComments []commentLine) (*Container, error) {
 	rootContainer := CreateContainer()
 	stack := []*Container{rootContainer}
+	blocksStack := []*Block{nil}
 	isNewBlock := true
 	tokenLine := -1
 
 	var currentBlock *Block
+	// Comments on the line of the previous token annotate its block, other ones
+	// annotate the next block
+	var previousBlock *Block
+	previousLine := -1
+	pendingComments := []string{}
+	addComments := func(comments []commentLine) {
+		for _, comment := range comments {
+			if previousBlock != nil && comment.line == previousLine {
+				previousBlock.AddComments(comment.text)
+			} else {
+				pendingComments = append(pendingComments, comment.text)
+			}
+		}
+	}
 
 	for _, token := range tokens {
+		addComments(token.comments)
 		if token.Line != tokenLine {
 			if tokenLine != -1 {
 				isNewBlock = true
@@ -191,25 +308,37 @@ func parseContainer(tokens []Token) (*Container, error) {
 		}
 		if token.Text == "}" {
 			if len(stack) == 1 {
-				return nil, fmt.Errorf("Unexpected token '}' at line %v", token.Line)
+				return nil, fmt.Errorf("Unexpected token '}' at line %v, column %v", token.Line, token.Column)
 			}
+			stack[len(stack)-1].AddTrailingComments(pendingComments...)
+			pendingComments = []string{}
+			previousBlock = blocksStack[len(blocksStack)-1]
 			stack = stack[:len(stack)-1]
+			blocksStack = blocksStack[:len(blocksStack)-1]
 		} else {
 			if isNewBlock {
 				parentBlock := stack[len(stack)-1]
 				currentBlock = CreateBlock()
 				currentBlock.Order = len(parentBlock.Children)
+				currentBlock.AddComments(pendingComments...)
+				pendingComments = []string{}
 				parentBlock.AddBlock(currentBlock)
 				isNewBlock = false
 			}
 			if token.Text == "{" {
 				stack = append(stack, currentBlock.Container)
+				blocksStack = append(blocksStack, currentBlock)
 			} else {
 				currentBlock.AddKeys(token.Text)
-				tokenLine += strings.Count(token.Text, "\n")
+				tokenLine += token.NumLineBreaks()
 			}
+			previousBlock = currentBlock
 		}
+		previousLine = token.Line + token.NumLineBreaks()
 	}
 
+	addComments(trailingComments)
+	rootContainer.AddTrailingComments(pendingComments...)
+
 	return rootContainer, nil
 }
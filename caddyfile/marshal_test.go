@@ -1,6 +1,7 @@
 package caddyfile
 
 import (
+	"fmt"
 	"os"
 	"regexp"
 	"strings"
@@ -54,3 +55,82 @@ func TestMarshalUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestMarshalUnmarshal_RoundTrip(t *testing.T) {
+	keys := []string{
+		"plain",
+		"with spaces",
+		`with "quotes"`,
+		"with `backticks` and \"quotes\"",
+		"multiple\nlines with `backticks`\n\n  and indentation",
+		"trailing line break\n",
+		"EOF\nmarker",
+		"<<EOF",
+	}
+
+	container := CreateContainer()
+	site := CreateBlock()
+	site.AddKeys("example.com")
+	container.AddBlock(site)
+	for _, key := range keys {
+		directive := CreateBlock()
+		directive.AddKeys("respond", key, "200")
+		site.AddBlock(directive)
+	}
+
+	content := container.Marshal()
+	unmarshaled, err := Unmarshal(content)
+	assert.NoError(t, err)
+	assert.Equal(t, string(content), string(unmarshaled.Marshal()))
+
+	unmarshaledKeys := []string{}
+	for _, directive := range unmarshaled.Children[0].Children {
+		assert.Len(t, directive.Keys, 3, "in %s", content)
+		unmarshaledKeys = append(unmarshaledKeys, directive.Keys[1])
+	}
+	assert.ElementsMatch(t, keys, unmarshaledKeys)
+}
+
+func TestUnmarshal_InvalidHeredoc(t *testing.T) {
+	_, err := Unmarshal([]byte("example.com {\n\trespond <<EOF\n\t\ttext\n}\n"))
+	assert.ErrorContains(t, err, "incomplete heredoc <<EOF")
+
+	_, err = Unmarshal([]byte("example.com {\n\trespond <<EOF\n\ttext\n\t\tEOF\n}\n"))
+	assert.ErrorContains(t, err, "mismatched leading whitespace in heredoc <<EOF")
+}
+
+func TestMarshalUnmarshal_CommentsAreStable(t *testing.T) {
+	container, err := Unmarshal([]byte("# b site\nb.example.com {\n\trespond b\n}\n# a site\na.example.com {\n\t# the response\n\trespond a\n}\n"))
+	assert.NoError(t, err)
+
+	// Sorting by keys moves comments along with their blocks
+	for _, block := range container.Children {
+		block.Order = 0
+	}
+	const expectedCaddyfile = "# a site\na.example.com {\n\t# the response\n\trespond a\n}\n# b site\nb.example.com {\n\trespond b\n}\n"
+	assert.Equal(t, expectedCaddyfile, string(container.Marshal()))
+
+	unmarshaled, err := Unmarshal(container.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, expectedCaddyfile, string(unmarshaled.Marshal()))
+}
+
+func TestAllTokens_LineAndColumn(t *testing.T) {
+	tokens, _, err := allTokens("", []byte("example.com {\n\trespond \"a b\" 200\n  respond <<EOF\n\tc\n\tEOF\n}\n"))
+	assert.NoError(t, err)
+
+	positions := []string{}
+	for _, token := range tokens {
+		positions = append(positions, fmt.Sprintf("%s:%d:%d", token.Text, token.Line, token.Column))
+	}
+	assert.Equal(t, []string{
+		"example.com:1:1",
+		"{:1:13",
+		"respond:2:2",
+		"a b:2:10",
+		"200:2:16",
+		"respond:3:3",
+		"c:3:11",
+		"}:6:1",
+	}, positions)
+}
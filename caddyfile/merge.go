@@ -1,38 +1,246 @@
 package caddyfile
 
-import "strings"
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
 
-// Merge a second caddyfile container into this container
-func (containerA *Container) Merge(containerB *Container) {
-OuterLoop:
+// MergeStrategy defines how a block is merged into a container already having
+// blocks of the same directive
+type MergeStrategy string
+
+const (
+	// MergeDefault merges the children of blocks with the same keys, keeping
+	// other blocks apart
+	MergeDefault MergeStrategy = "default"
+	// MergeAppendArgs appends the arguments of blocks with the same matcher
+	// to the first one, like upstreams of reverse_proxy
+	MergeAppendArgs MergeStrategy = "append-args"
+	// MergeChildren merges the children of blocks with the same matcher into
+	// the first one
+	MergeChildren MergeStrategy = "merge-children"
+	// MergeReplace replaces blocks with the same matcher by the last one
+	MergeReplace MergeStrategy = "replace"
+	// MergeKeepFirst keeps the first of the blocks with the same matcher
+	MergeKeepFirst MergeStrategy = "keep-first"
+	// MergeError keeps the first of the blocks with the same matcher, and
+	// reports the other ones as conflicts
+	MergeError MergeStrategy = "error"
+)
+
+// mergeStrategies maps directives to their merge strategy, directives not in
+// it use MergeDefault
+var mergeStrategies = map[string]MergeStrategy{
+	"reverse_proxy": MergeAppendArgs,
+	"php_fastcgi":   MergeAppendArgs,
+	"handle":        MergeChildren,
+	"handle_path":   MergeChildren,
+	"route":         MergeChildren,
+	"bind":          MergeError,
+	"encode":        MergeError,
+	"file_server":   MergeError,
+	"request_body":  MergeError,
+	"root":          MergeError,
+	"templates":     MergeError,
+	"tls":           MergeError,
+	"try_files":     MergeError,
+}
+
+var mergeStrategiesMutex sync.RWMutex
+
+// ParseMergeStrategy parses the name of a merge strategy
+func ParseMergeStrategy(value string) (MergeStrategy, error) {
+	switch strategy := MergeStrategy(strings.ToLower(strings.TrimSpace(value))); strategy {
+	case MergeDefault, MergeAppendArgs, MergeChildren, MergeReplace, MergeKeepFirst, MergeError:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("invalid merge strategy %q", value)
+	}
+}
+
+// RegisterMergeStrategy sets the merge strategy of a directive. Custom Caddy
+// builds can call it to merge the directives of their plugins.
+func RegisterMergeStrategy(directive string, strategy MergeStrategy) error {
+	if _, err := ParseMergeStrategy(string(strategy)); err != nil {
+		return err
+	}
+	mergeStrategiesMutex.Lock()
+	defer mergeStrategiesMutex.Unlock()
+	mergeStrategies[directive] = strategy
+	return nil
+}
+
+// RegisterSingleDirectives registers directives that can appear only once per
+// matcher, so different occurrences of them are reported as merge conflicts
+func RegisterSingleDirectives(names ...string) {
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			RegisterMergeStrategy(name, MergeError)
+		}
+	}
+}
+
+// GetMergeStrategy returns the merge strategy of a directive
+func GetMergeStrategy(directive string) MergeStrategy {
+	mergeStrategiesMutex.RLock()
+	defer mergeStrategiesMutex.RUnlock()
+	if strategy, ok := mergeStrategies[directive]; ok {
+		return strategy
+	}
+	return MergeDefault
+}
+
+// MergeStrategies returns the merge strategy of all registered directives
+func MergeStrategies() map[string]MergeStrategy {
+	mergeStrategiesMutex.RLock()
+	defer mergeStrategiesMutex.RUnlock()
+	strategies := make(map[string]MergeStrategy, len(mergeStrategies))
+	for directive, strategy := range mergeStrategies {
+		strategies[directive] = strategy
+	}
+	return strategies
+}
+
+// MergeConflict is a single directive defined differently by two merged
+// containers. The first definition is kept.
+type MergeConflict struct {
+	// Path contains the keys of the blocks enclosing the directive, like the site address
+	Path     []string
+	Kept     *Block
+	Rejected *Block
+}
+
+// Merge a second caddyfile container into this container.
+// Identical directives are collapsed, and the conflicts between different
+// definitions of single directives are returned.
+func (containerA *Container) Merge(containerB *Container) []MergeConflict {
+	conflicts := []MergeConflict{}
+	containerA.merge(containerB, []string{}, &conflicts)
+	return conflicts
+}
+
+func (containerA *Container) merge(containerB *Container, path []string, conflicts *[]MergeConflict) {
+	containerA.MergeTrailingComments(containerB.TrailingComments...)
+	// Blocks are merged only into the blocks containerA had, so blocks of the
+	// same source, like isolated labels, are kept apart
+	existing := containerA.Children
 	for _, blockB := range containerB.Children {
-		firstKey := blockB.GetFirstKey()
-		for _, blockA := range containerA.GetAllByFirstKey(firstKey) {
-			if (firstKey == "reverse_proxy" || firstKey == "php_fastcgi") && getMatcher(blockA) == getMatcher(blockB) {
-				mergeReverseProxyLike(blockA, blockB)
-				continue OuterLoop
-			} else if blocksAreEqual(blockA, blockB) {
-				blockA.Container.Merge(blockB.Container)
-				continue OuterLoop
+		if !mergeBlock(existing, blockB, path, conflicts) {
+			containerA.AddBlock(copyBlock(blockB))
+		}
+	}
+}
+
+// copyBlock copies a block and its children, so merging into the copy doesn't
+// change the merged container
+func copyBlock(block *Block) *Block {
+	result := &Block{
+		Container: CreateContainer(),
+		Order:     block.Order,
+		Keys:      slices.Clone(block.Keys),
+		Sources:   slices.Clone(block.Sources),
+		Comments:  slices.Clone(block.Comments),
+	}
+	result.TrailingComments = slices.Clone(block.TrailingComments)
+	result.rawPosition = block.rawPosition
+	for _, child := range block.Children {
+		result.AddBlock(copyBlock(child))
+	}
+	return result
+}
+
+// mergeBlock merges blockB into one of the existing blocks, following the merge
+// strategy of its directive. It returns false when blockB must be added apart.
+func mergeBlock(existing []*Block, blockB *Block, path []string, conflicts *[]MergeConflict) bool {
+	firstKey := blockB.GetFirstKey()
+	blocksA := []*Block{}
+	for _, block := range existing {
+		if block.GetFirstKey() == firstKey {
+			blocksA = append(blocksA, block)
+		}
+	}
+
+	for _, blockA := range blocksA {
+		if blocksAreIdentical(blockA, blockB) {
+			blockA.AddSources(blockB.Sources...)
+			blockA.MergeComments(blockB.Comments...)
+			return true
+		}
+	}
+
+	strategy := GetMergeStrategy(firstKey)
+	if strategy == MergeDefault || strategy == MergeError {
+		for _, blockA := range blocksA {
+			if blocksAreEqual(blockA, blockB) {
+				mergeChildren(blockA, blockB, path, conflicts)
+				return true
 			}
 		}
-		containerA.AddBlock(blockB)
 	}
+	if strategy == MergeDefault {
+		return false
+	}
+
+	for _, blockA := range blocksA {
+		if getMatcher(blockA) != getMatcher(blockB) {
+			continue
+		}
+		switch strategy {
+		case MergeAppendArgs:
+			mergeReverseProxyLike(blockA, blockB, path, conflicts)
+		case MergeChildren:
+			mergeChildren(blockA, blockB, path, conflicts)
+		case MergeReplace:
+			blockA.Order = blockB.Order
+			blockA.Keys = blockB.Keys
+			blockA.Sources = blockB.Sources
+			blockA.Comments = blockB.Comments
+			blockA.Container = copyBlock(blockB).Container
+		case MergeError:
+			*conflicts = append(*conflicts, MergeConflict{
+				Path:     path,
+				Kept:     blockA,
+				Rejected: blockB,
+			})
+		}
+		return true
+	}
+	return false
 }
 
-func mergeReverseProxyLike(blockA *Block, blockB *Block) {
+func mergeChildren(blockA *Block, blockB *Block, path []string, conflicts *[]MergeConflict) {
+	blockA.AddSources(blockB.Sources...)
+	blockA.MergeComments(blockB.Comments...)
+	blockA.Container.merge(blockB.Container, blockPath(path, blockA), conflicts)
+}
+
+func mergeReverseProxyLike(blockA *Block, blockB *Block, path []string, conflicts *[]MergeConflict) {
+	blockA.AddSources(blockB.Sources...)
+	blockA.MergeComments(blockB.Comments...)
 	for index, key := range blockB.Keys[1:] {
 		if index > 0 || !isMatcher(key) {
 			blockA.AddKeys(key)
 		}
 	}
-	blockA.Container.Merge(blockB.Container)
+	blockA.Container.merge(blockB.Container, blockPath(path, blockA), conflicts)
+}
+
+func blockPath(path []string, block *Block) []string {
+	return append(path[:len(path):len(path)], strings.Join(block.Keys, " "))
 }
 
+// getMatcher returns the matcher of a directive, "*" when it has none. The single
+// argument of a directive without children, like root /srv, is its value
+// rather than a path matcher.
 func getMatcher(block *Block) string {
 	if len(block.Keys) <= 1 || !isMatcher(block.Keys[1]) {
 		return "*"
 	}
+	if len(block.Keys) == 2 && len(block.Children) == 0 && strings.HasPrefix(block.Keys[1], "/") {
+		return "*"
+	}
 	return block.Keys[1]
 }
 
@@ -51,3 +259,16 @@ func blocksAreEqual(blockA *Block, blockB *Block) bool {
 	}
 	return true
 }
+
+// blocksAreIdentical returns if both blocks have the same keys and identical children
+func blocksAreIdentical(blockA *Block, blockB *Block) bool {
+	if !blocksAreEqual(blockA, blockB) || len(blockA.Children) != len(blockB.Children) {
+		return false
+	}
+	for i := range blockA.Children {
+		if !blocksAreIdentical(blockA.Children[i], blockB.Children[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -58,3 +58,102 @@ func TestMerge(t *testing.T) {
 		})
 	}
 }
+
+func TestMerge_KeepsSources(t *testing.T) {
+	container1, _ := Unmarshal([]byte("service.example.com {\n\treverse_proxy 10.0.0.1\n}\n"))
+	container1.SetSource("container a")
+	container2, _ := Unmarshal([]byte("service.example.com {\n\treverse_proxy 10.0.0.2\n\tencode gzip\n}\nother.example.com {\n\trespond 200\n}\n"))
+	container2.SetSource("container b")
+
+	container1.Merge(container2)
+
+	const expectedCaddyfile = "# source: container a, container b\n" +
+		"service.example.com {\n" +
+		"	reverse_proxy 10.0.0.1 10.0.0.2\n" +
+		"	# source: container b\n" +
+		"	encode gzip\n" +
+		"}\n" +
+		"# source: container b\n" +
+		"other.example.com {\n" +
+		"	respond 200\n" +
+		"}\n"
+
+	assert.Equal(t, expectedCaddyfile, string(container1.MarshalWithSources()))
+}
+
+func TestMerge_ReturnsConflicts(t *testing.T) {
+	container1, _ := Unmarshal([]byte("example.com {\n\ttls internal\n\thandle /api {\n\t\troot * /srv/a\n\t}\n}\n"))
+	container1.SetSource("container a")
+	container2, _ := Unmarshal([]byte("example.com {\n\ttls admin@example.com\n\thandle /api {\n\t\troot * /srv/b\n\t}\n}\n"))
+	container2.SetSource("container b")
+
+	conflicts := container1.Merge(container2)
+
+	assert.Len(t, conflicts, 2)
+	assert.Equal(t, []string{"example.com"}, conflicts[0].Path)
+	assert.Equal(t, "tls internal\n", string(conflicts[0].Kept.Marshal()))
+	assert.Equal(t, "tls admin@example.com\n", string(conflicts[0].Rejected.Marshal()))
+	assert.Equal(t, []string{"container b"}, conflicts[0].Rejected.Sources)
+	assert.Equal(t, []string{"example.com", "handle /api"}, conflicts[1].Path)
+	assert.Equal(t, "root * /srv/a\n", string(conflicts[1].Kept.Marshal()))
+}
+
+func TestMerge_RegisteredSingleDirectives(t *testing.T) {
+	container1, _ := Unmarshal([]byte("example.com {\n\tmy_directive a\n}\n"))
+	container2, _ := Unmarshal([]byte("example.com {\n\tmy_directive b\n}\n"))
+
+	RegisterSingleDirectives("my_directive")
+	defer func() {
+		mergeStrategiesMutex.Lock()
+		delete(mergeStrategies, "my_directive")
+		mergeStrategiesMutex.Unlock()
+	}()
+
+	conflicts := container1.Merge(container2)
+
+	assert.Len(t, conflicts, 1)
+	assert.Equal(t, "example.com {\n\tmy_directive a\n}\n", string(container1.Marshal()))
+}
+
+func TestMerge_Strategies(t *testing.T) {
+	tests := []struct {
+		strategy MergeStrategy
+		expected string
+	}{
+		{MergeDefault, "example.com {\n\tmy_directive /a first {\n\t\tsub 1\n\t}\n\tmy_directive /a second {\n\t\tsub 2\n\t}\n\tmy_directive /b third\n}\n"},
+		{MergeAppendArgs, "example.com {\n\tmy_directive /a first second {\n\t\tsub 1\n\t\tsub 2\n\t}\n\tmy_directive /b third\n}\n"},
+		{MergeChildren, "example.com {\n\tmy_directive /a first {\n\t\tsub 1\n\t\tsub 2\n\t}\n\tmy_directive /b third\n}\n"},
+		{MergeReplace, "example.com {\n\tmy_directive /a second {\n\t\tsub 2\n\t}\n\tmy_directive /b third\n}\n"},
+		{MergeKeepFirst, "example.com {\n\tmy_directive /a first {\n\t\tsub 1\n\t}\n\tmy_directive /b third\n}\n"},
+		{MergeError, "example.com {\n\tmy_directive /a first {\n\t\tsub 1\n\t}\n\tmy_directive /b third\n}\n"},
+	}
+
+	defer func() {
+		mergeStrategiesMutex.Lock()
+		delete(mergeStrategies, "my_directive")
+		mergeStrategiesMutex.Unlock()
+	}()
+
+	for _, test := range tests {
+		t.Run(string(test.strategy), func(t *testing.T) {
+			assert.NoError(t, RegisterMergeStrategy("my_directive", test.strategy))
+
+			container1, _ := Unmarshal([]byte("example.com {\n\tmy_directive /a first {\n\t\tsub 1\n\t}\n}\n"))
+			container2, _ := Unmarshal([]byte("example.com {\n\tmy_directive /a second {\n\t\tsub 2\n\t}\n\tmy_directive /b third\n}\n"))
+
+			conflicts := container1.Merge(container2)
+
+			assert.Equal(t, test.expected, string(container1.Marshal()))
+			if test.strategy == MergeError {
+				assert.Len(t, conflicts, 1)
+			} else {
+				assert.Empty(t, conflicts)
+			}
+		})
+	}
+}
+
+func TestRegisterMergeStrategy_Invalid(t *testing.T) {
+	assert.Error(t, RegisterMergeStrategy("my_directive", "concat"))
+	assert.Equal(t, MergeDefault, GetMergeStrategy("my_directive"))
+}
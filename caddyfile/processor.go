@@ -7,34 +7,200 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 )
 
+// strippableDirectives can be stripped alone from a site when invalid, because
+// they only encode, log or instrument responses. Sites with any other invalid
+// directive or matcher are removed, as requests would fall through to other
+// handlers, like file_server serving the sources php_fastcgi executes.
+var strippableDirectives = map[string]bool{
+	"encode":   true,
+	"log":      true,
+	"log_skip": true,
+	"metrics":  true,
+	"push":     true,
+	"skip_log": true,
+	"tracing":  true,
+}
+
+// processor removes invalid blocks from a caddyfile, adapting only as many
+// candidate caddyfiles as needed to isolate them
+type processor struct {
+	adapter   caddyconfig.Adapter
+	container *Container
+	// sharedBlocks are the valid global options, snippets and named routes
+	sharedBlocks []*Block
+	logs         *bytes.Buffer
+}
+
 // Process caddyfile and removes wrong server blocks
 func Process(caddyfileContent []byte) ([]byte, []byte) {
 	if len(caddyfileContent) == 0 {
 		return caddyfileContent, nil
 	}
 
-	logsBuffer := bytes.Buffer{}
-	adapter := caddyconfig.GetAdapter("caddyfile")
-
 	container, err := Unmarshal(caddyfileContent)
 	if err != nil {
-		logsBuffer.WriteString(fmt.Sprintf("[ERROR]  Invalid caddyfile: %s\n%s\n", err.Error(), caddyfileContent))
-		return nil, logsBuffer.Bytes()
+		return nil, []byte(fmt.Sprintf("[ERROR]  Invalid caddyfile: %s\n%s\n", err.Error(), caddyfileContent))
 	}
 
-	newContainer := CreateContainer()
+	processedContainer, logs := ProcessContainer(container)
+	return processedContainer.Marshal(), logs
+}
+
+// ProcessContainer returns a container with only the valid blocks of container,
+// and logs describing the removed ones along with their sources.
+// Global options and snippets are validated first, on their own. Sites are then
+// validated together, and only invalid groups of sites are bisected until the
+// invalid sites are isolated. Invalid directives safe to drop are stripped from
+// those sites, and sites with other invalid directives or without any valid
+// directive are removed.
+func ProcessContainer(container *Container) (*Container, []byte) {
+	logsBuffer := bytes.Buffer{}
+
+	p := &processor{
+		adapter:   caddyconfig.GetAdapter("caddyfile"),
+		container: CreateContainer(),
+		logs:      &logsBuffer,
+	}
 
 	container.sort()
+	sites := []*Block{}
 	for _, block := range container.Children {
-		newContainer.AddBlock(block)
+		if block.IsGlobalBlock() || block.IsSnippet() || block.IsNamedRoute() {
+			p.addSharedBlock(block)
+		} else {
+			sites = append(sites, block)
+		}
+	}
+	p.addSites(sites)
+
+	return p.container, logsBuffer.Bytes()
+}
+
+// addSharedBlock adds a global options block, snippet or named route, removing it when invalid
+func (p *processor) addSharedBlock(block *Block) {
+	p.container.AddBlock(block)
+	if err := p.adapt(); err != nil {
+		p.container.Remove(block)
+		p.logRemovedBlock(err, block)
+		return
+	}
+	p.sharedBlocks = append(p.sharedBlocks, block)
+}
+
+// addSites adds all valid sites, bisecting the ones that fail together
+func (p *processor) addSites(sites []*Block) {
+	if len(sites) == 0 {
+		return
+	}
+
+	for _, site := range sites {
+		p.container.AddBlock(site)
+	}
+	err := p.adapt()
+	if err == nil {
+		return
+	}
+	for _, site := range sites {
+		p.container.Remove(site)
+	}
 
-		_, _, err := adapter.Adapt(newContainer.Marshal(), nil)
+	if len(sites) == 1 {
+		p.addSiteDirectives(sites[0], err)
+		return
+	}
+
+	// Sites are added in order, so a site conflicting with a previous one is
+	// the one removed
+	half := len(sites) / 2
+	p.addSites(sites[:half])
+	p.addSites(sites[half:])
+}
 
-		if err != nil {
-			newContainer.Remove(block)
-			logsBuffer.WriteString(fmt.Sprintf("[ERROR]  Removing invalid block: %s\n%s\n", err.Error(), block.Marshal()))
+// addSiteDirectives adds an invalid site without its invalid directives, when
+// all of them are strippable, or removes the site otherwise. Matcher definitions
+// alone don't make a site valid. Directives are validated with the site alone.
+func (p *processor) addSiteDirectives(site *Block, siteErr error) {
+	strippedSite := &Block{
+		Container: CreateContainer(),
+		Order:     site.Order,
+		Keys:      site.Keys,
+		Sources:   site.Sources,
+		Comments:  site.Comments,
+	}
+	strippedSite.TrailingComments = site.TrailingComments
+
+	removedDirectives := []*Block{}
+	removedErrors := []error{}
+	for _, directive := range site.Children {
+		strippedSite.AddBlock(directive)
+		if err := p.adaptSite(strippedSite); err != nil {
+			if !strippableDirectives[directive.GetFirstKey()] {
+				p.logRemovedBlock(err, site)
+				return
+			}
+			strippedSite.Remove(directive)
+			removedDirectives = append(removedDirectives, directive)
+			removedErrors = append(removedErrors, err)
 		}
 	}
 
-	return newContainer.Marshal(), logsBuffer.Bytes()
+	if !strippedSite.hasDirectives() {
+		p.logRemovedBlock(siteErr, site)
+		return
+	}
+
+	// The stripped site can still conflict with previous sites
+	p.container.AddBlock(strippedSite)
+	if err := p.adapt(); err != nil {
+		p.container.Remove(strippedSite)
+		p.logRemovedBlock(err, site)
+		return
+	}
+
+	for i, directive := range removedDirectives {
+		p.logs.WriteString(fmt.Sprintf("[ERROR]  Removing invalid directive: %s\n%s\n", removedErrors[i].Error(), siteWithDirective(site, directive).MarshalWithSources()))
+	}
+}
+
+func (p *processor) adapt() error {
+	_, _, err := p.adapter.Adapt(p.container.Marshal(), nil)
+	return err
+}
+
+// adaptSite adapts a site with the shared blocks only
+func (p *processor) adaptSite(site *Block) error {
+	container := CreateContainer()
+	for _, block := range p.sharedBlocks {
+		container.AddBlock(block)
+	}
+	container.AddBlock(site)
+	_, _, err := p.adapter.Adapt(container.Marshal(), nil)
+	return err
+}
+
+func (p *processor) logRemovedBlock(err error, block *Block) {
+	p.logs.WriteString(fmt.Sprintf("[ERROR]  Removing invalid block: %s\n%s\n", err.Error(), block.MarshalWithSources()))
+}
+
+// siteWithDirective creates a copy of a site containing only one directive, to
+// log the directive in context
+func siteWithDirective(site *Block, directive *Block) *Block {
+	block := &Block{
+		Container: CreateContainer(),
+		Order:     site.Order,
+		Keys:      site.Keys,
+		Sources:   site.Sources,
+	}
+	block.AddBlock(directive)
+	return block
+}
+
+// hasDirectives returns if block has children other than matcher definitions
+func (block *Block) hasDirectives() bool {
+	for _, child := range block.Children {
+		if !child.IsMatcher() {
+			return true
+		}
+	}
+	return false
 }
@@ -1,6 +1,7 @@
 package caddyfile
 
 import (
+	"fmt"
 	"os"
 	"regexp"
 	"strings"
@@ -64,3 +65,33 @@ func TestProcessCaddyfile(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkProcessCaddyfile(b *testing.B) {
+	var caddyfile strings.Builder
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&caddyfile, "service%d.example.com {\n\treverse_proxy service%d:5000\n}\n", i, i)
+	}
+	caddyfile.WriteString("invalid.example.com {\n\treverse_proxy invalid:5000 {\n\t\tinvalid\n\t}\n}\n")
+	content := []byte(caddyfile.String())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Process(content)
+	}
+}
+
+func TestProcessContainer_LogsSources(t *testing.T) {
+	container, _ := Unmarshal([]byte("service1.example.com {\n\treverse_proxy service1:5000 {\n\t\tinvalid\n\t}\n}\n"))
+	container.SetSource("container service1")
+
+	result, logs := ProcessContainer(container)
+
+	assert.Empty(t, result.Children)
+	assert.Equal(t, "[ERROR]  Removing invalid block: parsing caddyfile tokens for 'reverse_proxy': unrecognized subdirective invalid, at Caddyfile:3\n"+
+		"# source: container service1\n"+
+		"service1.example.com {\n"+
+		"	reverse_proxy service1:5000 {\n"+
+		"		invalid\n"+
+		"	}\n"+
+		"}\n\n", string(logs))
+}
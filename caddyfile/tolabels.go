@@ -0,0 +1,130 @@
+package caddyfile
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var orderedNameRegex = regexp.MustCompile(`^\d+_`)
+var isolatedNameRegex = regexp.MustCompile(`_\d+$`)
+
+// ToLabels converts a caddyfile into labels that FromLabels converts back into
+// the same caddyfile. Comments are not converted, and sites are sorted like in
+// generated caddyfiles. The labels are verified by converting them back.
+func ToLabels(container *Container, prefix string) (map[string]string, error) {
+	expected := copyForLabels(container)
+	for _, block := range expected.Children {
+		block.Order = math.MaxInt32
+	}
+	expected.sort()
+
+	labels := map[string]string{}
+	for index, block := range expected.Children {
+		path := prefix
+		if len(expected.Children) > 1 {
+			path = fmt.Sprintf("%s_%d", prefix, index+1)
+		}
+		labels[path] = labelValue(block.Keys)
+		if err := addChildrenLabels(labels, path, block.Container); err != nil {
+			return nil, err
+		}
+	}
+
+	converted, err := FromLabels(labels, nil, template.FuncMap{})
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(converted.Marshal(), expected.Marshal()) {
+		return nil, fmt.Errorf("labels don't convert back into the same caddyfile")
+	}
+	return labels, nil
+}
+
+func addChildrenLabels(labels map[string]string, parentPath string, container *Container) error {
+	ordered := needsOrder(container.Children)
+	names := map[string]int{}
+	for _, block := range container.Children {
+		names[block.GetFirstKey()]++
+	}
+
+	occurrences := map[string]int{}
+	for index, block := range container.Children {
+		name := block.GetFirstKey()
+		if name == rawLabelName {
+			return fmt.Errorf("directive %s can't be converted into a label", name)
+		}
+		occurrences[name]++
+
+		labelName := strings.ReplaceAll(name, ".", `\.`)
+		if ordered {
+			labelName = strconv.Itoa(index+1) + "_" + labelName
+		}
+		if !ordered && names[name] > 1 {
+			labelName += "_" + strconv.Itoa(occurrences[name])
+		} else if isolatedNameRegex.MatchString(name) {
+			// Suffix keeping the name suffix from being read as isolation
+			labelName += "_0"
+		}
+
+		path := parentPath + "." + labelName
+		labels[path] = labelValue(block.Keys[1:])
+		if err := addChildrenLabels(labels, path, block.Container); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// needsOrder returns if sorted blocks must be ordered with label prefixes to
+// keep their order, or to keep their name prefix from being read as order
+func needsOrder(blocks []*Block) bool {
+	for _, block := range blocks {
+		if orderedNameRegex.MatchString(block.GetFirstKey()) {
+			return true
+		}
+	}
+
+	unordered := make([]*Block, len(blocks))
+	for index, block := range blocks {
+		unorderedBlock := *block
+		unorderedBlock.Order = math.MaxInt32
+		unordered[index] = &unorderedBlock
+	}
+	sort.SliceStable(unordered, func(i, j int) bool {
+		return compareBlocks(unordered[i], unordered[j]) == -1
+	})
+
+	for index := range blocks {
+		if blocks[index].Container != unordered[index].Container {
+			return true
+		}
+	}
+	return false
+}
+
+// labelValue formats keys as a label value, escaping go template delimiters
+func labelValue(keys []string) string {
+	buffer := &bytes.Buffer{}
+	writeKeys(buffer, keys, 0)
+	return strings.ReplaceAll(buffer.String(), "{{", `{{"{{"}}`)
+}
+
+// copyForLabels copies a container without the comments and sources labels
+// can't define
+func copyForLabels(container *Container) *Container {
+	result := CreateContainer()
+	for _, block := range container.Children {
+		result.AddBlock(&Block{
+			Container: copyForLabels(block.Container),
+			Order:     block.Order,
+			Keys:      block.Keys,
+		})
+	}
+	return result
+}
@@ -0,0 +1,63 @@
+package caddyfile
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaddyfileToLabels(t *testing.T) {
+	// load the list of test files from the dir
+	files, err := os.ReadDir("./testdata/tolabels")
+	if err != nil {
+		t.Errorf("failed to read tolabels dir: %s", err)
+	}
+
+	// prep a regexp to fix strings on windows
+	winNewlines := regexp.MustCompile(`\r?\n`)
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		// read the test file
+		filename := f.Name()
+
+		t.Run(filename, func(t *testing.T) {
+			data, err := os.ReadFile("./testdata/tolabels/" + filename)
+			if err != nil {
+				t.Errorf("failed to read %s dir: %s", filename, err)
+			}
+
+			// split the Caddyfile (first) and labels (second) parts
+			parts := strings.Split(winNewlines.ReplaceAllString(string(data), "\n"), "----------")
+			caddyfileString, labelsString := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+			// parse label key-value pairs
+			expectedLabels, err := parseLabelsFromString(labelsString)
+			require.NoError(t, err, "failed to parse labels from %s", filename)
+
+			container, err := Unmarshal([]byte(caddyfileString))
+			require.NoError(t, err, "failed to unmarshal %s", filename)
+
+			// convert the Caddyfile to labels
+			actualLabels, err := ToLabels(container, "caddy")
+			require.NoError(t, err, "expected no error in %s", filename)
+
+			assert.Equal(t, expectedLabels, actualLabels, "comparison failed in %s", filename)
+		})
+	}
+}
+
+func TestCaddyfileToLabels_RawDirective(t *testing.T) {
+	container, err := Unmarshal([]byte("example.com {\n\traw on\n}"))
+	require.NoError(t, err)
+
+	_, err = ToLabels(container, "caddy")
+	assert.EqualError(t, err, "directive raw can't be converted into a label")
+}
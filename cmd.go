@@ -14,6 +14,7 @@ import (
 	caddylogging "github.com/caddyserver/caddy/v2/modules/logging"
 	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
 	"github.com/lucaslorentz/caddy-docker-proxy/v2/generator"
+	"github.com/spf13/cobra"
 
 	"go.uber.org/zap"
 )
@@ -21,7 +22,7 @@ import (
 var isTrue = regexp.MustCompile("(?i)^(true|yes|1)$")
 
 func init() {
-	caddycmd.RegisterCommand(caddycmd.Command{
+	command := caddycmd.Command{
 		Name:  "docker-proxy",
 		Func:  cmdFunc,
 		Usage: "<command>",
@@ -41,6 +42,10 @@ func init() {
 			fs.String("docker-apis-version", "",
 				"Docker socket apis version comma separate")
 
+			fs.String("docker-hosts-address", "",
+				"Docker hosts address comma separate, where published ports are reachable (one per socket).\n"+
+					"When not defined, the host of tcp sockets is used")
+
 			fs.String("controller-network", "",
 				"Network allowed to configure caddy server in CIDR notation. Ex: 10.200.200.0/24")
 
@@ -48,6 +53,16 @@ func init() {
 				"Comma separated name of ingress networks connecting caddy servers to containers.\n"+
 					"When not defined, networks attached to controller container are considered ingress networks")
 
+			fs.String("ingress-networks-label", "",
+				"Label marking docker networks as ingress networks when set to true.\n"+
+					"When not defined, <label-prefix>_ingress is used")
+
+			fs.Bool("auto-attach-networks", false,
+				"Connect containers and services with caddy labels to the first ingress network when they aren't in any ingress network")
+
+			fs.Bool("create-ingress-network", false,
+				"Create the first ingress network at startup when it doesn't exist")
+
 			fs.String("caddyfile-path", "",
 				"Path to a base Caddyfile that will be extended with docker sites")
 
@@ -60,9 +75,41 @@ func init() {
 			fs.Bool("proxy-service-tasks", true,
 				"Proxy to service tasks instead of service load balancer")
 
+			fs.String("upstreams-mode", string(config.UpstreamsIP),
+				"Which addresses upstreams resolve to: ip | published | hostname")
+
+			fs.String("upstreams-ip-family", string(config.IPv4),
+				"Which IP addresses upstreams resolve to: v4 | v6 | both | prefer-v6")
+
+			fs.String("labels-policy", "",
+				"Path to a JSON policy file restricting domains, global options, snippets and directives configured by labels")
+
+			fs.String("rules", "",
+				"Path to a JSON file of CEL rules warning about, mutating or rejecting generated sites")
+
+			fs.String("single-directives", "",
+				"Comma separated directives, besides the built-in ones, that can appear only once per matcher in a site.\n"+
+					"Different definitions of them from merged sources are reported as conflicts, keeping the first one")
+
+			fs.String("merge-strategies", "",
+				"Comma separated directive=strategy pairs overriding how directives from different sources are merged.\n"+
+					"Strategies: default | append-args | merge-children | replace | keep-first | error")
+
+			fs.Bool("traefik-labels", false,
+				"Translate the Traefik router, service and middleware labels of containers and services into Caddyfile sites")
+
+			fs.Bool("nginx-proxy-env", false,
+				"Proxy containers with the VIRTUAL_HOST, VIRTUAL_PORT, VIRTUAL_PATH and LETSENCRYPT_HOST environment variables of nginx-proxy")
+
+			fs.String("site-conflict-policy", string(config.SiteConflictMerge),
+				"How sites with the same address from different containers or services are resolved: merge | first-wins | reject | owner-label")
+
 			fs.Bool("process-caddyfile", true,
 				"Process Caddyfile before loading it, removing invalid servers")
 
+			fs.Bool("caddyfile-source-comments", false,
+				"Add comments to the generated Caddyfile with the containers, services, configs or files each block comes from")
+
 			fs.Bool("scan-stopped-containers", false,
 				"Scan stopped containers and use its labels for caddyfile generation")
 
@@ -80,7 +127,13 @@ func init() {
 
 			return fs
 		}(),
-	})
+	}
+	command.CobraFunc = func(cmd *cobra.Command) {
+		cmd.Flags().AddGoFlagSet(command.Flags)
+		cmd.RunE = caddycmd.WrapCommandFuncForCobra(command.Func)
+		cmd.AddCommand(createToLabelsCommand())
+	}
+	caddycmd.RegisterCommand(command)
 }
 
 func cmdFunc(flags caddycmd.Flags) (int, error) {
@@ -181,12 +234,12 @@ func getAdminListen(options *config.Options) string {
 				switch v := a.(type) {
 				case *net.IPAddr:
 					if options.ControllerNetwork.Contains(v.IP) {
-						return "tcp/" + v.IP.String() + ":2019"
+						return "tcp/" + net.JoinHostPort(v.IP.String(), "2019")
 					}
 					break
 				case *net.IPNet:
 					if options.ControllerNetwork.Contains(v.IP) {
-						return "tcp/" + v.IP.String() + ":2019"
+						return "tcp/" + net.JoinHostPort(v.IP.String(), "2019")
 					}
 					break
 				}
@@ -222,6 +275,7 @@ func createOptions(flags caddycmd.Flags) *config.Options {
 	labelPrefixFlag := flags.String("label-prefix")
 	proxyServiceTasksFlag := flags.Bool("proxy-service-tasks")
 	processCaddyfileFlag := flags.Bool("process-caddyfile")
+	caddyfileSourceCommentsFlag := flags.Bool("caddyfile-source-comments")
 	scanStoppedContainersFlag := flags.Bool("scan-stopped-containers")
 	pollingIntervalFlag := flags.Duration("polling-interval")
 	eventThrottleIntervalFlag := flags.Duration("event-throttle-interval")
@@ -230,7 +284,20 @@ func createOptions(flags caddycmd.Flags) *config.Options {
 	dockerSocketsFlag := flags.String("docker-sockets")
 	dockerCertsPathFlag := flags.String("docker-certs-path")
 	dockerAPIsVersionFlag := flags.String("docker-apis-version")
+	dockerHostsAddressFlag := flags.String("docker-hosts-address")
+	upstreamsModeFlag := flags.String("upstreams-mode")
+	upstreamsIPFamilyFlag := flags.String("upstreams-ip-family")
+	siteConflictPolicyFlag := flags.String("site-conflict-policy")
+	labelsPolicyFlag := flags.String("labels-policy")
+	rulesFlag := flags.String("rules")
+	singleDirectivesFlag := flags.String("single-directives")
+	mergeStrategiesFlag := flags.String("merge-strategies")
+	traefikLabelsFlag := flags.Bool("traefik-labels")
+	nginxProxyEnvFlag := flags.Bool("nginx-proxy-env")
 	ingressNetworksFlag := flags.String("ingress-networks")
+	ingressNetworksLabelFlag := flags.String("ingress-networks-label")
+	autoAttachNetworksFlag := flags.Bool("auto-attach-networks")
+	createIngressNetworkFlag := flags.Bool("create-ingress-network")
 	logLevelFlag := flags.String("log-level")
 	logFormatFlag := flags.String("log-format")
 
@@ -277,6 +344,12 @@ func createOptions(flags caddycmd.Flags) *config.Options {
 		options.DockerAPIsVersion = strings.Split(dockerAPIsVersionFlag, ",")
 	}
 
+	if dockerHostsAddressEnv := os.Getenv("CADDY_DOCKER_HOSTS_ADDRESS"); dockerHostsAddressEnv != "" {
+		options.DockerHostsAddress = strings.Split(dockerHostsAddressEnv, ",")
+	} else {
+		options.DockerHostsAddress = strings.Split(dockerHostsAddressFlag, ",")
+	}
+
 	if controllerIPRangeEnv := os.Getenv("CADDY_CONTROLLER_NETWORK"); controllerIPRangeEnv != "" {
 		_, ipNet, err := net.ParseCIDR(controllerIPRangeEnv)
 		if err != nil {
@@ -299,6 +372,18 @@ func createOptions(flags caddycmd.Flags) *config.Options {
 		options.IngressNetworks = strings.Split(ingressNetworksFlag, ",")
 	}
 
+	if autoAttachNetworksEnv := os.Getenv("CADDY_DOCKER_AUTO_ATTACH_NETWORKS"); autoAttachNetworksEnv != "" {
+		options.AutoAttachNetworks = isTrue.MatchString(autoAttachNetworksEnv)
+	} else {
+		options.AutoAttachNetworks = autoAttachNetworksFlag
+	}
+
+	if createIngressNetworkEnv := os.Getenv("CADDY_DOCKER_CREATE_INGRESS_NETWORK"); createIngressNetworkEnv != "" {
+		options.CreateIngressNetwork = isTrue.MatchString(createIngressNetworkEnv)
+	} else {
+		options.CreateIngressNetwork = createIngressNetworkFlag
+	}
+
 	if caddyfilePathEnv := os.Getenv("CADDY_DOCKER_CADDYFILE_PATH"); caddyfilePathEnv != "" {
 		options.CaddyfilePath = caddyfilePathEnv
 	} else {
@@ -318,18 +403,122 @@ func createOptions(flags caddycmd.Flags) *config.Options {
 	}
 	options.ControlledServersLabel = options.LabelPrefix + "_controlled_server"
 
+	if ingressNetworksLabelEnv := os.Getenv("CADDY_INGRESS_NETWORKS_LABEL"); ingressNetworksLabelEnv != "" {
+		options.IngressNetworksLabel = ingressNetworksLabelEnv
+	} else if ingressNetworksLabelFlag != "" {
+		options.IngressNetworksLabel = ingressNetworksLabelFlag
+	} else {
+		options.IngressNetworksLabel = options.LabelPrefix + "_ingress"
+	}
+
 	if proxyServiceTasksEnv := os.Getenv("CADDY_DOCKER_PROXY_SERVICE_TASKS"); proxyServiceTasksEnv != "" {
 		options.ProxyServiceTasks = isTrue.MatchString(proxyServiceTasksEnv)
 	} else {
 		options.ProxyServiceTasks = proxyServiceTasksFlag
 	}
 
+	var upstreamsMode string
+	if upstreamsModeEnv := os.Getenv("CADDY_DOCKER_UPSTREAMS_MODE"); upstreamsModeEnv != "" {
+		upstreamsMode = upstreamsModeEnv
+	} else {
+		upstreamsMode = upstreamsModeFlag
+	}
+	switch mode := config.UpstreamsMode(strings.ToLower(upstreamsMode)); mode {
+	case config.UpstreamsIP, config.UpstreamsPublished, config.UpstreamsHostname:
+		options.UpstreamsMode = mode
+	default:
+		log.Error("Ignoring invalid upstreams mode", zap.String("upstreams-mode", upstreamsMode))
+		options.UpstreamsMode = config.UpstreamsIP
+	}
+
+	var upstreamsIPFamily string
+	if upstreamsIPFamilyEnv := os.Getenv("CADDY_DOCKER_UPSTREAMS_IP_FAMILY"); upstreamsIPFamilyEnv != "" {
+		upstreamsIPFamily = upstreamsIPFamilyEnv
+	} else {
+		upstreamsIPFamily = upstreamsIPFamilyFlag
+	}
+	switch family := config.IPFamily(strings.ToLower(upstreamsIPFamily)); family {
+	case config.IPv4, config.IPv6, config.IPBoth, config.IPPreferV6:
+		options.UpstreamsIPFamily = family
+	default:
+		log.Error("Ignoring invalid upstreams IP family", zap.String("upstreams-ip-family", upstreamsIPFamily))
+		options.UpstreamsIPFamily = config.IPv4
+	}
+
+	if labelsPolicyEnv := os.Getenv("CADDY_DOCKER_LABELS_POLICY"); labelsPolicyEnv != "" {
+		options.LabelsPolicyPath = labelsPolicyEnv
+	} else {
+		options.LabelsPolicyPath = labelsPolicyFlag
+	}
+
+	if rulesEnv := os.Getenv("CADDY_DOCKER_RULES"); rulesEnv != "" {
+		options.RulesPath = rulesEnv
+	} else {
+		options.RulesPath = rulesFlag
+	}
+
+	if traefikLabelsEnv := os.Getenv("CADDY_DOCKER_TRAEFIK_LABELS"); traefikLabelsEnv != "" {
+		options.TraefikLabels = isTrue.MatchString(traefikLabelsEnv)
+	} else {
+		options.TraefikLabels = traefikLabelsFlag
+	}
+
+	if nginxProxyEnvEnv := os.Getenv("CADDY_DOCKER_NGINX_PROXY_ENV"); nginxProxyEnvEnv != "" {
+		options.NginxProxyEnv = isTrue.MatchString(nginxProxyEnvEnv)
+	} else {
+		options.NginxProxyEnv = nginxProxyEnvFlag
+	}
+
+	if singleDirectivesEnv := os.Getenv("CADDY_DOCKER_SINGLE_DIRECTIVES"); singleDirectivesEnv != "" {
+		options.SingleDirectives = strings.Split(singleDirectivesEnv, ",")
+	} else if singleDirectivesFlag != "" {
+		options.SingleDirectives = strings.Split(singleDirectivesFlag, ",")
+	}
+
+	var mergeStrategies string
+	if mergeStrategiesEnv := os.Getenv("CADDY_DOCKER_MERGE_STRATEGIES"); mergeStrategiesEnv != "" {
+		mergeStrategies = mergeStrategiesEnv
+	} else {
+		mergeStrategies = mergeStrategiesFlag
+	}
+	if mergeStrategies != "" {
+		options.MergeStrategies = map[string]string{}
+		for _, pair := range strings.Split(mergeStrategies, ",") {
+			directive, strategy, found := strings.Cut(pair, "=")
+			if !found || strings.TrimSpace(directive) == "" {
+				log.Error("Ignoring invalid merge strategy", zap.String("merge-strategies", pair))
+				continue
+			}
+			options.MergeStrategies[strings.TrimSpace(directive)] = strings.TrimSpace(strategy)
+		}
+	}
+
+	var siteConflictPolicy string
+	if siteConflictPolicyEnv := os.Getenv("CADDY_DOCKER_SITE_CONFLICT_POLICY"); siteConflictPolicyEnv != "" {
+		siteConflictPolicy = siteConflictPolicyEnv
+	} else {
+		siteConflictPolicy = siteConflictPolicyFlag
+	}
+	switch policy := config.SiteConflictPolicy(strings.ToLower(siteConflictPolicy)); policy {
+	case config.SiteConflictMerge, config.SiteConflictFirstWins, config.SiteConflictReject, config.SiteConflictOwnerLabel:
+		options.SiteConflictPolicy = policy
+	default:
+		log.Error("Ignoring invalid site conflict policy", zap.String("site-conflict-policy", siteConflictPolicy))
+		options.SiteConflictPolicy = config.SiteConflictMerge
+	}
+
 	if processCaddyfileEnv := os.Getenv("CADDY_DOCKER_PROCESS_CADDYFILE"); processCaddyfileEnv != "" {
 		options.ProcessCaddyfile = isTrue.MatchString(processCaddyfileEnv)
 	} else {
 		options.ProcessCaddyfile = processCaddyfileFlag
 	}
 
+	if caddyfileSourceCommentsEnv := os.Getenv("CADDY_DOCKER_CADDYFILE_SOURCE_COMMENTS"); caddyfileSourceCommentsEnv != "" {
+		options.CaddyfileSourceComments = isTrue.MatchString(caddyfileSourceCommentsEnv)
+	} else {
+		options.CaddyfileSourceComments = caddyfileSourceCommentsFlag
+	}
+
 	if scanStoppedContainersEnv := os.Getenv("CADDY_DOCKER_SCAN_STOPPED_CONTAINERS"); scanStoppedContainersEnv != "" {
 		options.ScanStoppedContainers = isTrue.MatchString(scanStoppedContainersEnv)
 	} else {
@@ -7,24 +7,38 @@ import (
 
 // Options are the options for generator
 type Options struct {
-	CaddyfilePath          string
-	EnvFile                string
-	AdminListen            string
-	AdminDisabled          bool
-	DockerSockets          []string
-	DockerCertsPath        []string
-	DockerAPIsVersion      []string
-	LabelPrefix            string
-	ControlledServersLabel string
-	ProxyServiceTasks      bool
-	ProcessCaddyfile       bool
-	ScanStoppedContainers  bool
-	PollingInterval        time.Duration
-	EventThrottleInterval  time.Duration
-	Mode                   Mode
-	Secret                 string
-	ControllerNetwork      *net.IPNet
-	IngressNetworks        []string
+	CaddyfilePath           string
+	EnvFile                 string
+	AdminListen             string
+	AdminDisabled           bool
+	DockerSockets           []string
+	DockerCertsPath         []string
+	DockerAPIsVersion       []string
+	LabelPrefix             string
+	ControlledServersLabel  string
+	ProxyServiceTasks       bool
+	ProcessCaddyfile        bool
+	CaddyfileSourceComments bool
+	ScanStoppedContainers   bool
+	PollingInterval         time.Duration
+	EventThrottleInterval   time.Duration
+	Mode                    Mode
+	Secret                  string
+	ControllerNetwork       *net.IPNet
+	IngressNetworks         []string
+	IngressNetworksLabel    string
+	UpstreamsMode           UpstreamsMode
+	UpstreamsIPFamily       IPFamily
+	DockerHostsAddress      []string
+	AutoAttachNetworks      bool
+	CreateIngressNetwork    bool
+	SiteConflictPolicy      SiteConflictPolicy
+	LabelsPolicyPath        string
+	RulesPath               string
+	SingleDirectives        []string
+	MergeStrategies         map[string]string
+	TraefikLabels           bool
+	NginxProxyEnv           bool
 
 	// LogLevel and LogFormat configure Caddy's logging (level and encoder).
 	// They apply in all modes — including controller mode, via a minimal
@@ -45,3 +59,45 @@ const (
 	// Standalone runs controller and server in a single instance
 	Standalone Mode = Controller | Server
 )
+
+// UpstreamsMode represents which addresses the upstreams template function resolves to
+type UpstreamsMode string
+
+const (
+	// UpstreamsIP resolves to container and task IPs in ingress networks
+	UpstreamsIP UpstreamsMode = "ip"
+	// UpstreamsPublished resolves to the docker host address and published ports
+	UpstreamsPublished UpstreamsMode = "published"
+	// UpstreamsHostname resolves to container and service DNS names
+	UpstreamsHostname UpstreamsMode = "hostname"
+)
+
+// SiteConflictPolicy represents how sites declared with the same address by
+// different containers or services are resolved
+type SiteConflictPolicy string
+
+const (
+	// SiteConflictMerge merges conflicting sites
+	SiteConflictMerge SiteConflictPolicy = "merge"
+	// SiteConflictFirstWins keeps the site of the oldest container or service
+	SiteConflictFirstWins SiteConflictPolicy = "first-wins"
+	// SiteConflictReject removes all conflicting sites
+	SiteConflictReject SiteConflictPolicy = "reject"
+	// SiteConflictOwnerLabel merges conflicting sites with the same owner label,
+	// and keeps the site of the oldest owner otherwise
+	SiteConflictOwnerLabel SiteConflictPolicy = "owner-label"
+)
+
+// IPFamily represents which address families upstreams use
+type IPFamily string
+
+const (
+	// IPv4 uses only IPv4 addresses
+	IPv4 IPFamily = "v4"
+	// IPv6 uses only IPv6 addresses
+	IPv6 IPFamily = "v6"
+	// IPBoth uses IPv4 and IPv6 addresses
+	IPBoth IPFamily = "both"
+	// IPPreferV6 uses the IPv6 address of each endpoint, or its IPv4 address when it has no IPv6
+	IPPreferV6 IPFamily = "prefer-v6"
+)
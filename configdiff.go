@@ -0,0 +1,185 @@
+package caddydockerproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configPatch is an admin API request changing a single path of the config
+type configPatch struct {
+	Method string
+	Path   string
+	Body   []byte
+}
+
+// configChange is a path of the config that differs between two configs, and
+// the admin API method that would apply it on its own
+type configChange struct {
+	Method string
+	Path   []string
+}
+
+// diffConfig computes the admin API request that turns the previous config into
+// the next one, or nil when they don't differ. Caddy reloads the whole config on
+// every request to /config, so all the changes are sent as one request at their
+// deepest common parent path. It returns an error when the change can't be
+// applied safely with a targeted request, and the whole config must be loaded
+// instead.
+func diffConfig(previous, next []byte) (*configPatch, error) {
+	if previous == nil {
+		return nil, fmt.Errorf("no previous config")
+	}
+
+	var previousConfig, nextConfig map[string]interface{}
+	if err := json.Unmarshal(previous, &previousConfig); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(next, &nextConfig); err != nil {
+		return nil, err
+	}
+
+	// Only apps are patched, changes to the admin endpoint, logging or storage
+	// affect the whole instance
+	for _, key := range unionKeys(previousConfig, nextConfig) {
+		if key != "apps" && !reflect.DeepEqual(previousConfig[key], nextConfig[key]) {
+			return nil, fmt.Errorf("%s changed", key)
+		}
+	}
+
+	previousApps, _ := previousConfig["apps"].(map[string]interface{})
+	nextApps, _ := nextConfig["apps"].(map[string]interface{})
+	for _, key := range unionKeys(previousApps, nextApps) {
+		_, inPrevious := previousApps[key]
+		_, inNext := nextApps[key]
+		if inPrevious != inNext {
+			return nil, fmt.Errorf("app %s added or removed", key)
+		}
+	}
+
+	changes := []configChange{}
+	diffValue(&changes, []string{"apps"}, previousConfig["apps"], nextConfig["apps"])
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	// A single change keeps its own method, several changes replace their
+	// common parent, which exists in both configs
+	change := changes[0]
+	for _, other := range changes[1:] {
+		change = configChange{
+			Method: "PATCH",
+			Path:   commonPath(change.Path, other.Path),
+		}
+	}
+
+	var value interface{}
+	if change.Method != "DELETE" {
+		value = valueAt(nextConfig, change.Path)
+	}
+	return newConfigPatch(change.Method, change.Path, value)
+}
+
+func diffValue(changes *[]configChange, path []string, previous, next interface{}) {
+	switch nextValue := next.(type) {
+	case map[string]interface{}:
+		if previousValue, ok := previous.(map[string]interface{}); ok {
+			diffObject(changes, path, previousValue, nextValue)
+			return
+		}
+	case []interface{}:
+		// Arrays are only compared per element when their length didn't change,
+		// inserting or removing elements shifts every following index
+		if previousValue, ok := previous.([]interface{}); ok && len(previousValue) == len(nextValue) {
+			for i := range nextValue {
+				diffValue(changes, append(path[:len(path):len(path)], strconv.Itoa(i)), previousValue[i], nextValue[i])
+			}
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(previous, next) {
+		*changes = append(*changes, configChange{Method: "PATCH", Path: path})
+	}
+}
+
+func diffObject(changes *[]configChange, path []string, previous, next map[string]interface{}) {
+	for _, key := range unionKeys(previous, next) {
+		keyPath := append(path[:len(path):len(path)], key)
+		previousValue, inPrevious := previous[key]
+		nextValue, inNext := next[key]
+
+		switch {
+		case !inNext:
+			*changes = append(*changes, configChange{Method: "DELETE", Path: keyPath})
+		case !inPrevious:
+			*changes = append(*changes, configChange{Method: "PUT", Path: keyPath})
+		default:
+			diffValue(changes, keyPath, previousValue, nextValue)
+		}
+	}
+}
+
+func commonPath(a, b []string) []string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return a[:i:i]
+}
+
+// valueAt returns the value at path, which must exist in config
+func valueAt(config map[string]interface{}, path []string) interface{} {
+	var value interface{} = config
+	for _, key := range path {
+		switch container := value.(type) {
+		case map[string]interface{}:
+			value = container[key]
+		case []interface{}:
+			index, _ := strconv.Atoi(key)
+			value = container[index]
+		}
+	}
+	return value
+}
+
+func newConfigPatch(method string, path []string, value interface{}) (*configPatch, error) {
+	for _, key := range path {
+		if key == "" || strings.Contains(key, "/") {
+			return nil, fmt.Errorf("key %q can't be addressed by the admin API", key)
+		}
+	}
+
+	patch := &configPatch{
+		Method: method,
+		Path:   "/config/" + strings.Join(path, "/"),
+	}
+	if method != "DELETE" {
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(value); err != nil {
+			return nil, err
+		}
+		patch.Body = bytes.TrimSpace(buffer.Bytes())
+	}
+	return patch, nil
+}
+
+func unionKeys(a, b map[string]interface{}) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, exists := a[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
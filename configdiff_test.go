@@ -0,0 +1,152 @@
+package caddydockerproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const baseDiffConfig = `{
+	"admin": {"listen": "tcp/0.0.0.0:2019"},
+	"apps": {
+		"http": {
+			"servers": {
+				"srv0": {
+					"listen": [":443"],
+					"routes": [
+						{"match": [{"host": ["a.example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.1:80"}]}]},
+						{"match": [{"host": ["b.example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.2:80"}]}]}
+					]
+				}
+			}
+		}
+	}
+}`
+
+func TestDiffConfig_ChangedUpstream(t *testing.T) {
+	next := `{
+	"admin": {"listen": "tcp/0.0.0.0:2019"},
+	"apps": {
+		"http": {
+			"servers": {
+				"srv0": {
+					"listen": [":443"],
+					"routes": [
+						{"match": [{"host": ["a.example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.1:80"}]}]},
+						{"match": [{"host": ["b.example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.3:80"}, {"dial": "10.0.0.4:80"}]}]}
+					]
+				}
+			}
+		}
+	}
+}`
+
+	patch, err := diffConfig([]byte(baseDiffConfig), []byte(next))
+	require.NoError(t, err)
+	assert.Equal(t, &configPatch{
+		Method: "PATCH",
+		Path:   "/config/apps/http/servers/srv0/routes/1/handle/0/upstreams",
+		Body:   []byte(`[{"dial":"10.0.0.3:80"},{"dial":"10.0.0.4:80"}]`),
+	}, patch)
+}
+
+func TestDiffConfig_AddedAndRemovedKeys(t *testing.T) {
+	next := `{
+	"admin": {"listen": "tcp/0.0.0.0:2019"},
+	"apps": {
+		"http": {
+			"servers": {
+				"srv0": {
+					"listen": [":443"],
+					"routes": [
+						{"match": [{"host": ["a.example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.1:80"}]}]},
+						{"match": [{"host": ["b.example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.2:80"}]}]}
+					]
+				},
+				"srv1": {"listen": [":8080"]}
+			}
+		}
+	}
+}`
+
+	patch, err := diffConfig([]byte(baseDiffConfig), []byte(next))
+	require.NoError(t, err)
+	assert.Equal(t, &configPatch{
+		Method: "PUT", Path: "/config/apps/http/servers/srv1", Body: []byte(`{"listen":[":8080"]}`),
+	}, patch)
+
+	patch, err = diffConfig([]byte(next), []byte(baseDiffConfig))
+	require.NoError(t, err)
+	assert.Equal(t, &configPatch{
+		Method: "DELETE", Path: "/config/apps/http/servers/srv1",
+	}, patch)
+}
+
+func TestDiffConfig_ChangesPatchCommonParent(t *testing.T) {
+	next := `{
+	"admin": {"listen": "tcp/0.0.0.0:2019"},
+	"apps": {
+		"http": {
+			"servers": {
+				"srv0": {
+					"listen": [":443"],
+					"routes": [
+						{"match": [{"host": ["a.example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.5:80"}]}]},
+						{"match": [{"host": ["b.example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.6:80"}]}]}
+					]
+				}
+			}
+		}
+	}
+}`
+
+	patch, err := diffConfig([]byte(baseDiffConfig), []byte(next))
+	require.NoError(t, err)
+	assert.Equal(t, "PATCH", patch.Method)
+	assert.Equal(t, "/config/apps/http/servers/srv0/routes", patch.Path)
+	assert.JSONEq(t, `[
+		{"match": [{"host": ["a.example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.5:80"}]}]},
+		{"match": [{"host": ["b.example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.6:80"}]}]}
+	]`, string(patch.Body))
+}
+
+func TestDiffConfig_Unchanged(t *testing.T) {
+	patch, err := diffConfig([]byte(baseDiffConfig), []byte(baseDiffConfig))
+	require.NoError(t, err)
+	assert.Nil(t, patch)
+}
+
+func TestDiffConfig_FallsBackToLoad(t *testing.T) {
+	testCases := map[string]struct {
+		previous string
+		next     string
+	}{
+		"no previous config": {
+			next: baseDiffConfig,
+		},
+		"admin changed": {
+			previous: baseDiffConfig,
+			next:     `{"admin": {"listen": "tcp/0.0.0.0:2020"}, "apps": {}}`,
+		},
+		"app added": {
+			previous: `{"apps": {"http": {}}}`,
+			next:     `{"apps": {"http": {}, "tls": {}}}`,
+		},
+		"key not addressable": {
+			previous: `{"apps": {"http": {"a/b": 1}}}`,
+			next:     `{"apps": {"http": {"a/b": 2}}}`,
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var previous []byte
+			if testCase.previous != "" {
+				previous = []byte(testCase.previous)
+			}
+			_, err := diffConfig(previous, []byte(testCase.next))
+			assert.Error(t, err)
+		})
+	}
+}
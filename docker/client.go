@@ -20,6 +20,9 @@ type Client interface {
 	ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error)
 	NetworkInspect(ctx context.Context, networkID string, options client.NetworkInspectOptions) (network.Inspect, error)
 	NetworkList(ctx context.Context, options client.NetworkListOptions) ([]network.Summary, error)
+	NetworkCreate(ctx context.Context, name string, options client.NetworkCreateOptions) (string, error)
+	NetworkConnect(ctx context.Context, networkID string, containerID string) error
+	ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, spec swarm.ServiceSpec) error
 	ConfigList(ctx context.Context, options client.ConfigListOptions) ([]swarm.Config, error)
 	ConfigInspectWithRaw(ctx context.Context, id string) (swarm.Config, []byte, error)
 	Events(ctx context.Context, options client.EventsListOptions) (<-chan events.Message, <-chan error)
@@ -76,6 +79,21 @@ func (wrapper *clientWrapper) NetworkList(ctx context.Context, options client.Ne
 	return result.Items, err
 }
 
+func (wrapper *clientWrapper) NetworkCreate(ctx context.Context, name string, options client.NetworkCreateOptions) (string, error) {
+	result, err := wrapper.client.NetworkCreate(ctx, name, options)
+	return result.ID, err
+}
+
+func (wrapper *clientWrapper) NetworkConnect(ctx context.Context, networkID string, containerID string) error {
+	_, err := wrapper.client.NetworkConnect(ctx, networkID, client.NetworkConnectOptions{Container: containerID})
+	return err
+}
+
+func (wrapper *clientWrapper) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, spec swarm.ServiceSpec) error {
+	_, err := wrapper.client.ServiceUpdate(ctx, serviceID, client.ServiceUpdateOptions{Version: version, Spec: spec})
+	return err
+}
+
 func (wrapper *clientWrapper) ConfigInspectWithRaw(ctx context.Context, id string) (swarm.Config, []byte, error) {
 	result, err := wrapper.client.ConfigInspect(ctx, id, client.ConfigInspectOptions{})
 	return result.Config, result.Raw, err
@@ -19,9 +19,14 @@ type ClientMock struct {
 	TasksData            []swarm.Task
 	TaskListErr          error
 	NetworksData         []network.Summary
+	NetworkListErr       error
 	InfoData             system.Info
 	ContainerInspectData map[string]container.InspectResponse
+	ContainerInspectErr  error
 	NetworkInspectData   map[string]network.Inspect
+	NetworkConnections   map[string][]string
+	CreatedNetworks      map[string]client.NetworkCreateOptions
+	ServiceUpdates       map[string]swarm.ServiceSpec
 	EventsChannel        chan events.Message
 	ErrorsChannel        chan error
 }
@@ -61,6 +66,9 @@ func (mock *ClientMock) ConfigList(ctx context.Context, options client.ConfigLis
 
 // NetworkList list all networks
 func (mock *ClientMock) NetworkList(ctx context.Context, options client.NetworkListOptions) ([]network.Summary, error) {
+	if mock.NetworkListErr != nil {
+		return nil, mock.NetworkListErr
+	}
 	return mock.NetworksData, nil
 }
 
@@ -71,6 +79,9 @@ func (mock *ClientMock) Info(ctx context.Context) (system.Info, error) {
 
 // ContainerInspect returns information about a specific container
 func (mock *ClientMock) ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
+	if mock.ContainerInspectErr != nil {
+		return container.InspectResponse{}, mock.ContainerInspectErr
+	}
 	return mock.ContainerInspectData[containerID], nil
 }
 
@@ -79,6 +90,33 @@ func (mock *ClientMock) NetworkInspect(ctx context.Context, networkID string, op
 	return mock.NetworkInspectData[networkID], nil
 }
 
+// NetworkCreate records the creation of a network
+func (mock *ClientMock) NetworkCreate(ctx context.Context, name string, options client.NetworkCreateOptions) (string, error) {
+	if mock.CreatedNetworks == nil {
+		mock.CreatedNetworks = map[string]client.NetworkCreateOptions{}
+	}
+	mock.CreatedNetworks[name] = options
+	return name + "-id", nil
+}
+
+// NetworkConnect records the connection of a container to a network
+func (mock *ClientMock) NetworkConnect(ctx context.Context, networkID string, containerID string) error {
+	if mock.NetworkConnections == nil {
+		mock.NetworkConnections = map[string][]string{}
+	}
+	mock.NetworkConnections[networkID] = append(mock.NetworkConnections[networkID], containerID)
+	return nil
+}
+
+// ServiceUpdate records the update of a service spec
+func (mock *ClientMock) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, spec swarm.ServiceSpec) error {
+	if mock.ServiceUpdates == nil {
+		mock.ServiceUpdates = map[string]swarm.ServiceSpec{}
+	}
+	mock.ServiceUpdates[serviceID] = spec
+	return nil
+}
+
 // ConfigInspectWithRaw return sinformation about a specific config
 func (mock *ClientMock) ConfigInspectWithRaw(ctx context.Context, id string) (swarm.Config, []byte, error) {
 	for _, config := range mock.ConfigsData {
@@ -0,0 +1,100 @@
+package caddydockerproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/generator"
+)
+
+func init() {
+	caddy.RegisterModule(DockerUpstreams{})
+}
+
+// upstreamsIndex is the index of the docker loader running in this process
+var upstreamsIndex atomic.Pointer[generator.UpstreamsIndex]
+
+// DockerUpstreams resolves reverse_proxy upstreams at request time from the
+// containers and services discovered by the docker loader running in the same
+// Caddy instance.
+type DockerUpstreams struct {
+	// Selector of the docker resources to proxy to, as rendered by
+	// {{upstreams dynamic}}: compose/<project>/<service>, container/<name>
+	// or service/<name>
+	Selector string `json:"selector,omitempty"`
+	// Port of the upstreams, defaults to 80
+	Port string `json:"port,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (DockerUpstreams) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.upstreams.docker",
+		New: func() caddy.Module { return new(DockerUpstreams) },
+	}
+}
+
+// Provision validates the module configuration
+func (du *DockerUpstreams) Provision(ctx caddy.Context) error {
+	if du.Selector == "" {
+		return fmt.Errorf("docker upstreams selector is required")
+	}
+	if du.Port == "" {
+		du.Port = "80"
+	}
+	if _, err := strconv.Atoi(du.Port); err != nil {
+		return fmt.Errorf("invalid docker upstreams port %q: %w", du.Port, err)
+	}
+	return nil
+}
+
+// GetUpstreams returns the upstreams of the docker resources matching the selector
+func (du *DockerUpstreams) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	index := upstreamsIndex.Load()
+	if index == nil {
+		return nil, fmt.Errorf("docker upstreams require the docker proxy loader to run in this instance")
+	}
+
+	hosts := index.Get(du.Selector)
+	upstreams := make([]*reverseproxy.Upstream, 0, len(hosts))
+	for _, host := range hosts {
+		upstreams = append(upstreams, &reverseproxy.Upstream{
+			Dial: net.JoinHostPort(host, du.Port),
+		})
+	}
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile deserializes Caddyfile tokens into du.
+//
+//	dynamic docker <selector> [<port>]
+func (du *DockerUpstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume upstream source name
+
+	args := d.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return d.ArgErr()
+	}
+	du.Selector = args[0]
+	if len(args) == 2 {
+		du.Port = args[1]
+	}
+
+	if d.NextBlock(0) {
+		return d.Errf("unrecognized docker upstreams option '%s'", d.Val())
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*DockerUpstreams)(nil)
+	_ reverseproxy.UpstreamSource = (*DockerUpstreams)(nil)
+	_ caddyfile.Unmarshaler       = (*DockerUpstreams)(nil)
+)
@@ -0,0 +1,39 @@
+package caddydockerproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/generator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDockerUpstreams_UnmarshalCaddyfile(t *testing.T) {
+	du := &DockerUpstreams{}
+	require.NoError(t, du.UnmarshalCaddyfile(caddyfile.NewTestDispenser("docker compose/project/web 8080")))
+	assert.Equal(t, DockerUpstreams{Selector: "compose/project/web", Port: "8080"}, *du)
+
+	du = &DockerUpstreams{}
+	require.NoError(t, du.UnmarshalCaddyfile(caddyfile.NewTestDispenser("docker container/web")))
+	assert.Equal(t, DockerUpstreams{Selector: "container/web"}, *du)
+
+	du = &DockerUpstreams{}
+	assert.Error(t, du.UnmarshalCaddyfile(caddyfile.NewTestDispenser("docker")))
+}
+
+func TestDockerUpstreams_GetUpstreams(t *testing.T) {
+	du := &DockerUpstreams{Selector: "container/web", Port: "80"}
+	request := httptest.NewRequest("GET", "/", nil)
+
+	upstreamsIndex.Store(nil)
+	_, err := du.GetUpstreams(request)
+	assert.Error(t, err)
+
+	upstreamsIndex.Store(&generator.UpstreamsIndex{})
+	defer upstreamsIndex.Store(nil)
+	upstreams, err := du.GetUpstreams(request)
+	require.NoError(t, err)
+	assert.Empty(t, upstreams)
+}
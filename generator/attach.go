@@ -0,0 +1,147 @@
+package generator
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/docker"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/network"
+	"github.com/moby/moby/api/types/swarm"
+	"github.com/moby/moby/client"
+
+	"go.uber.org/zap"
+)
+
+// PrimaryIngressNetwork returns the network that containers and services are
+// attached to by AutoAttachNetworks, the first of the configured ingress networks
+func (g *CaddyfileGenerator) PrimaryIngressNetwork() string {
+	if len(g.options.IngressNetworks) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(g.options.IngressNetworks[0])
+}
+
+// CreateIngressNetwork creates the primary ingress network in each docker host
+// where it doesn't exist yet, and connects this container to it when serving
+func (g *CaddyfileGenerator) CreateIngressNetwork(logger *zap.Logger) {
+	networkName := g.PrimaryIngressNetwork()
+	if networkName == "" {
+		logger.Warn("Skipping ingress network creation because no ingress network is configured")
+		return
+	}
+
+	for i, dockerClient := range g.dockerClients {
+		networkListFilter := make(client.Filters)
+		networkListFilter.Add("name", networkName)
+		networks, err := dockerClient.NetworkList(context.Background(), client.NetworkListOptions{Filters: networkListFilter})
+		if err != nil {
+			logger.Error("Failed to list networks", zap.Error(err))
+			continue
+		}
+		// The name filter matches partially
+		if slices.ContainsFunc(networks, func(n network.Summary) bool { return n.Name == networkName }) {
+			continue
+		}
+
+		createOptions := client.NetworkCreateOptions{
+			Driver: "bridge",
+			Labels: map[string]string{},
+		}
+		if info, err := dockerClient.Info(context.Background()); err == nil && info.Swarm.LocalNodeState == swarm.LocalNodeStateActive {
+			createOptions.Driver = "overlay"
+			createOptions.Scope = "swarm"
+			createOptions.Attachable = true
+		}
+		if g.options.IngressNetworksLabel != "" {
+			createOptions.Labels[g.options.IngressNetworksLabel] = "true"
+		}
+
+		networkID, err := dockerClient.NetworkCreate(context.Background(), networkName, createOptions)
+		if err != nil {
+			logger.Error("Failed to create ingress network", zap.String("network", networkName), zap.Error(err))
+			continue
+		}
+		logger.Info("Created ingress network", zap.String("network", networkName), zap.String("networkId", networkID), zap.String("driver", createOptions.Driver))
+		g.InvalidateNetworks(i)
+
+		if g.options.Mode&config.Server == config.Server {
+			containerID, err := g.dockerUtils.GetCurrentContainerID()
+			if err == nil {
+				err = dockerClient.NetworkConnect(context.Background(), networkID, containerID)
+			}
+			if err != nil {
+				logger.Error("Failed to attach caddy to ingress network", zap.String("network", networkName), zap.Error(err))
+			} else {
+				logger.Info("Attached caddy to ingress network", zap.String("network", networkName), zap.String("container", containerID))
+			}
+		}
+	}
+}
+
+// attachContainerToIngressNetwork connects a container with caddy labels to the
+// primary ingress network when it isn't in any ingress network
+func (g *CaddyfileGenerator) attachContainerToIngressNetwork(dockerClient docker.Client, container *container.Summary, logger *zap.Logger) {
+	networkName := g.PrimaryIngressNetwork()
+	if networkName == "" || len(g.filterLabels(container.Labels)) == 0 {
+		return
+	}
+	// Containers choosing their own networks are left untouched
+	if _, overrideNetwork := container.Labels[IngressNetworkLabel]; overrideNetwork {
+		return
+	}
+	networkMode := container.HostConfig.NetworkMode
+	if networkMode == "host" || networkMode == "none" || strings.HasPrefix(networkMode, "container:") {
+		return
+	}
+	if container.NetworkSettings != nil {
+		for name, endpoint := range container.NetworkSettings.Networks {
+			if g.ingressNetworks[endpoint.NetworkID] || g.ingressNetworks[name] || name == networkName {
+				return
+			}
+		}
+	}
+
+	g.countAPICall("NetworkConnect")
+	err := dockerClient.NetworkConnect(context.Background(), networkName, container.ID)
+	if err != nil {
+		logger.Error("Failed to attach container to ingress network", zap.String("container", containerName(container)), zap.String("network", networkName), zap.Error(err))
+		return
+	}
+	logger.Info("Attached container to ingress network", zap.String("container", containerName(container)), zap.String("network", networkName))
+}
+
+// attachServiceToIngressNetwork adds the primary ingress network to a service with
+// caddy labels when it isn't in any ingress network. Docker redeploys its tasks.
+func (g *CaddyfileGenerator) attachServiceToIngressNetwork(dockerClient docker.Client, service *swarm.Service, logger *zap.Logger) {
+	networkName := g.PrimaryIngressNetwork()
+	if networkName == "" || len(g.filterLabels(service.Spec.Labels)) == 0 {
+		return
+	}
+	if _, overrideNetwork := service.Spec.Labels[IngressNetworkLabel]; overrideNetwork {
+		return
+	}
+	for _, attachment := range service.Spec.TaskTemplate.Networks {
+		if g.ingressNetworks[attachment.Target] || attachment.Target == networkName || g.getNetworkName(attachment.Target, logger) == networkName {
+			return
+		}
+	}
+	for _, virtualIP := range service.Endpoint.VirtualIPs {
+		if g.ingressNetworks[virtualIP.NetworkID] || g.getNetworkName(virtualIP.NetworkID, logger) == networkName {
+			return
+		}
+	}
+
+	spec := service.Spec
+	spec.TaskTemplate.Networks = append(slices.Clone(spec.TaskTemplate.Networks), swarm.NetworkAttachmentConfig{Target: networkName})
+
+	g.countAPICall("ServiceUpdate")
+	err := dockerClient.ServiceUpdate(context.Background(), service.ID, service.Version, spec)
+	if err != nil {
+		logger.Error("Failed to attach service to ingress network", zap.String("service", service.Spec.Name), zap.String("network", networkName), zap.Error(err))
+		return
+	}
+	logger.Info("Attached service to ingress network", zap.String("service", service.Spec.Name), zap.String("network", networkName))
+}
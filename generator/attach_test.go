@@ -0,0 +1,191 @@
+package generator
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/docker"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/network"
+	"github.com/moby/moby/api/types/swarm"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestAttach_ContainersAndServices(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.NetworksData = []network.Summary{
+		networkSummary("ingress-network-id", "ingress-network"),
+	}
+	dockerClient.ContainersData = []container.Summary{
+		{
+			ID:    "OUTSIDE-ID",
+			Names: []string{"/outside"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"other-network": {
+						IPAddress: netip.MustParseAddr("10.0.0.1"),
+						NetworkID: "other-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s"):               "outside.testdomain.com",
+				fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+			},
+		},
+		{
+			ID:    "INSIDE-ID",
+			Names: []string{"/inside"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"ingress-network": {
+						IPAddress: netip.MustParseAddr("10.0.1.1"),
+						NetworkID: "ingress-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s"):               "inside.testdomain.com",
+				fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+			},
+		},
+		{
+			ID:    "UNLABELED-ID",
+			Names: []string{"/unlabeled"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{},
+			},
+		},
+	}
+	dockerClient.ServicesData = []swarm.Service{
+		{
+			ID: "SERVICE-ID",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "service",
+					Labels: map[string]string{
+						fmtLabel("%s"):               "service.testdomain.com",
+						fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+					},
+				},
+			},
+			Endpoint: swarm.Endpoint{
+				VirtualIPs: []swarm.EndpointVirtualIP{
+					{NetworkID: "other-network-id"},
+				},
+			},
+		},
+	}
+
+	generator := CreateGenerator([]docker.Client{dockerClient}, createDockerUtilsMock(), &config.Options{
+		LabelPrefix:        DefaultLabelPrefix,
+		IngressNetworks:    []string{"ingress-network"},
+		AutoAttachNetworks: true,
+	})
+	generator.GenerateCaddyfile(zap.NewNop())
+
+	assert.Equal(t, map[string][]string{"ingress-network": {"OUTSIDE-ID"}}, dockerClient.NetworkConnections)
+	assert.Equal(t, []swarm.NetworkAttachmentConfig{{Target: "ingress-network"}}, dockerClient.ServiceUpdates["SERVICE-ID"].TaskTemplate.Networks)
+}
+
+func attachDockerClient() *docker.ClientMock {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.NetworkInspectData["ingress-network-id"] = networkInspect("ingress-network-id", "ingress-network")
+	dockerClient.ContainersData = []container.Summary{
+		{
+			ID:    "INSIDE-ID",
+			Names: []string{"/inside"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"ingress-network": {
+						IPAddress: netip.MustParseAddr("10.0.1.1"),
+						NetworkID: "ingress-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s"):               "inside.testdomain.com",
+				fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+			},
+		},
+	}
+	dockerClient.ServicesData = []swarm.Service{
+		{
+			ID: "SERVICE-ID",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "service",
+					Labels: map[string]string{
+						fmtLabel("%s"):               "service.testdomain.com",
+						fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+					},
+				},
+				TaskTemplate: swarm.TaskSpec{
+					Networks: []swarm.NetworkAttachmentConfig{{Target: "ingress-network-id"}},
+				},
+			},
+		},
+	}
+	return dockerClient
+}
+
+func TestAttach_PrimaryIngressNetworkByName(t *testing.T) {
+	// The ingress network isn't listed yet, like when it was just created
+	dockerClient := attachDockerClient()
+
+	generator := CreateGenerator([]docker.Client{dockerClient}, createDockerUtilsMock(), &config.Options{
+		LabelPrefix:        DefaultLabelPrefix,
+		IngressNetworks:    []string{"ingress-network"},
+		AutoAttachNetworks: true,
+	})
+	generator.GenerateCaddyfile(zap.NewNop())
+
+	assert.Empty(t, dockerClient.NetworkConnections)
+	assert.Empty(t, dockerClient.ServiceUpdates)
+}
+
+func TestAttach_SkippedWhenIngressNetworksAreUnknown(t *testing.T) {
+	dockerClient := attachDockerClient()
+	dockerClient.NetworkListErr = errors.New("connection refused")
+	dockerClient.ContainersData[0].NetworkSettings.Networks = map[string]*network.EndpointSettings{}
+	dockerClient.ServicesData[0].Spec.TaskTemplate.Networks = nil
+
+	generator := CreateGenerator([]docker.Client{dockerClient}, createDockerUtilsMock(), &config.Options{
+		LabelPrefix:        DefaultLabelPrefix,
+		IngressNetworks:    []string{"ingress-network"},
+		AutoAttachNetworks: true,
+	})
+	generator.GenerateCaddyfile(zap.NewNop())
+
+	assert.Empty(t, dockerClient.NetworkConnections)
+	assert.Empty(t, dockerClient.ServiceUpdates)
+}
+
+func TestAttach_CreateIngressNetwork(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+
+	generator := CreateGenerator([]docker.Client{dockerClient}, createDockerUtilsMock(), &config.Options{
+		LabelPrefix:          DefaultLabelPrefix,
+		IngressNetworks:      []string{"ingress-network"},
+		IngressNetworksLabel: "caddy_ingress",
+		Mode:                 config.Standalone,
+	})
+	generator.CreateIngressNetwork(zap.NewNop())
+
+	createOptions := dockerClient.CreatedNetworks["ingress-network"]
+	assert.Equal(t, "overlay", createOptions.Driver)
+	assert.True(t, createOptions.Attachable)
+	assert.Equal(t, map[string]string{"caddy_ingress": "true"}, createOptions.Labels)
+	assert.Equal(t, map[string][]string{"ingress-network-id": {caddyContainerID}}, dockerClient.NetworkConnections)
+
+	// Existing networks are not created again
+	dockerClient.CreatedNetworks = nil
+	dockerClient.NetworksData = []network.Summary{
+		networkSummary("ingress-network-id", "ingress-network"),
+	}
+	generator.CreateIngressNetwork(zap.NewNop())
+	assert.Empty(t, dockerClient.CreatedNetworks)
+}
@@ -0,0 +1,223 @@
+package generator
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/caddyfile"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+	"go.uber.org/zap"
+)
+
+// sourceCaddyfile is a caddyfile waiting to be merged, along with the docker
+// resource it was generated from
+type sourceCaddyfile struct {
+	caddyfile *caddyfile.Container
+	source    string
+	// owner identifies the resource, with all replicas of a compose service
+	// sharing the same one. Caddyfiles without owner, from the base Caddyfile
+	// and Swarm configs, are trusted and always win conflicts.
+	owner     string
+	siteOwner string
+	created   time.Time
+	labels    map[string]string
+}
+
+// siteOwner groups the caddyfiles of a resource declaring a site address
+type siteOwner struct {
+	id        string
+	trusted   bool
+	siteOwner string
+	created   time.Time
+	sources   []*sourceCaddyfile
+}
+
+// resolveSiteConflicts detects sites declared with the same address by different
+// containers or services, and removes the site addresses rejected by the
+// configured policy. Sites of trusted caddyfiles are never rejected, and reject
+// the conflicting sites of containers and services unless merging, when they
+// are extended instead.
+func (g *CaddyfileGenerator) resolveSiteConflicts(sourceCaddyfiles []*sourceCaddyfile, logger *zap.Logger) {
+	ownersByAddress := map[string][]*siteOwner{}
+	for _, sourceCaddyfile := range sourceCaddyfiles {
+		for _, block := range sourceCaddyfile.caddyfile.Children {
+			for _, address := range siteAddresses(block) {
+				address = normalizeSiteAddress(address)
+				ownersByAddress[address] = addSiteOwner(ownersByAddress[address], sourceCaddyfile)
+			}
+		}
+	}
+
+	policy := g.options.SiteConflictPolicy
+	if policy == "" {
+		policy = config.SiteConflictMerge
+	}
+
+	for _, address := range sortedKeys(ownersByAddress) {
+		owners := ownersByAddress[address]
+		untrusted := countUntrusted(owners)
+		if len(owners) < 2 || untrusted == 0 || (policy == config.SiteConflictMerge && untrusted < 2) {
+			continue
+		}
+
+		sort.SliceStable(owners, func(i, j int) bool {
+			if owners[i].trusted != owners[j].trusted {
+				return owners[i].trusted
+			}
+			if !owners[i].created.Equal(owners[j].created) {
+				return owners[i].created.Before(owners[j].created)
+			}
+			return owners[i].id < owners[j].id
+		})
+
+		rejected := []*siteOwner{}
+		for i, owner := range owners {
+			if owner.trusted {
+				continue
+			}
+			switch policy {
+			case config.SiteConflictFirstWins:
+				if i > 0 {
+					rejected = append(rejected, owner)
+				}
+			case config.SiteConflictReject:
+				rejected = append(rejected, owner)
+			case config.SiteConflictOwnerLabel:
+				if i > 0 && (owners[0].siteOwner == "" || owner.siteOwner != owners[0].siteOwner) {
+					rejected = append(rejected, owner)
+				}
+			}
+		}
+
+		fields := []zap.Field{
+			zap.String("address", address),
+			zap.String("policy", string(policy)),
+			zap.Strings("sources", siteOwnersSources(owners)),
+		}
+		if len(rejected) == 0 {
+			logger.Info("Site address conflict, merging sites", fields...)
+			continue
+		}
+		logger.Warn("Site address conflict, rejecting sites", append(fields, zap.Strings("rejected", siteOwnersSources(rejected)))...)
+
+		for _, owner := range rejected {
+			for _, sourceCaddyfile := range owner.sources {
+				removeSiteAddress(sourceCaddyfile.caddyfile, address)
+			}
+		}
+	}
+}
+
+func addSiteOwner(owners []*siteOwner, source *sourceCaddyfile) []*siteOwner {
+	id := source.owner
+	if id == "" {
+		id = source.source
+	}
+	for _, owner := range owners {
+		if owner.id == id {
+			if source.created.Before(owner.created) {
+				owner.created = source.created
+			}
+			for _, existing := range owner.sources {
+				if existing == source {
+					return owners
+				}
+			}
+			owner.sources = append(owner.sources, source)
+			return owners
+		}
+	}
+	return append(owners, &siteOwner{
+		id:        id,
+		trusted:   source.owner == "",
+		siteOwner: source.siteOwner,
+		created:   source.created,
+		sources:   []*sourceCaddyfile{source},
+	})
+}
+
+func countUntrusted(owners []*siteOwner) int {
+	count := 0
+	for _, owner := range owners {
+		if !owner.trusted {
+			count++
+		}
+	}
+	return count
+}
+
+func siteOwnersSources(owners []*siteOwner) []string {
+	sources := []string{}
+	for _, owner := range owners {
+		for _, sourceCaddyfile := range owner.sources {
+			sources = append(sources, sourceCaddyfile.source)
+		}
+	}
+	return sources
+}
+
+// siteAddresses returns the normalized addresses of a site block
+func siteAddresses(block *caddyfile.Block) []string {
+	if block.IsGlobalBlock() || block.IsSnippet() || block.IsNamedRoute() || block.IsMatcher() {
+		return nil
+	}
+	addresses := []string{}
+	for _, key := range block.Keys {
+		for _, address := range strings.Split(key, ",") {
+			address = strings.ToLower(strings.TrimSpace(address))
+			if address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	return addresses
+}
+
+// normalizeSiteAddress returns the address without scheme and default ports,
+// so addresses of the same site are equal
+func normalizeSiteAddress(address string) string {
+	if i := strings.Index(address, "://"); i >= 0 {
+		address = address[i+3:]
+	}
+	path := ""
+	if i := strings.Index(address, "/"); i >= 0 {
+		address, path = address[:i], address[i:]
+	}
+	if host, port, err := net.SplitHostPort(address); err == nil && (port == "80" || port == "443") {
+		address = host
+		if strings.Contains(host, ":") {
+			address = "[" + host + "]"
+		}
+	}
+	return address + path
+}
+
+// removeSiteAddress removes an address from the sites of a container, removing
+// the sites left without addresses
+func removeSiteAddress(container *caddyfile.Container, address string) {
+	for _, block := range container.Children {
+		addresses := siteAddresses(block)
+		remaining := make([]string, 0, len(addresses))
+		for _, blockAddress := range addresses {
+			if normalizeSiteAddress(blockAddress) != address {
+				remaining = append(remaining, blockAddress)
+			}
+		}
+		if len(remaining) == len(addresses) {
+			continue
+		}
+		if len(remaining) == 0 {
+			container.Remove(block)
+			continue
+		}
+		block.Keys = block.Keys[:0]
+		for i, blockAddress := range remaining {
+			if i < len(remaining)-1 {
+				blockAddress += ","
+			}
+			block.AddKeys(blockAddress)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package generator
+
+import (
+	"testing"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/swarm"
+)
+
+func conflictingContainer(name string, ip string, created int64, labels map[string]string) container.Summary {
+	containerLabels := map[string]string{
+		fmtLabel("%s"):               "app.example.com",
+		fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+	}
+	for key, value := range labels {
+		containerLabels[key] = value
+	}
+	conflictingContainer := createContainer(name, ip, containerLabels)
+	conflictingContainer.Created = created
+	return conflictingContainer
+}
+
+func TestSiteConflicts_Merge(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		conflictingContainer("team-a", "172.17.0.2", 100, nil),
+		conflictingContainer("team-b", "172.17.0.3", 50, nil),
+	}
+
+	const expectedCaddyfile = "app.example.com {\n" +
+		"	reverse_proxy 172.17.0.2 172.17.0.3\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`INFO	Site address conflict, merging sites	{"address": "app.example.com", "policy": "merge", "sources": ["container team-b", "container team-a"]}` + newLine
+
+	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
+}
+
+func TestSiteConflicts_FirstWins(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		conflictingContainer("team-a", "172.17.0.2", 100, nil),
+		conflictingContainer("team-b", "172.17.0.3", 50, nil),
+	}
+
+	const expectedCaddyfile = "app.example.com {\n" +
+		"	reverse_proxy 172.17.0.3\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Site address conflict, rejecting sites	{"address": "app.example.com", "policy": "first-wins", "sources": ["container team-b", "container team-a"], "rejected": ["container team-a"]}` + newLine
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.SiteConflictPolicy = config.SiteConflictFirstWins
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestSiteConflicts_Reject(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		conflictingContainer("team-a", "172.17.0.2", 100, nil),
+		conflictingContainer("team-b", "172.17.0.3", 50, nil),
+	}
+
+	const expectedCaddyfile = "# Empty caddyfile"
+
+	const expectedLogs = commonLogs +
+		`WARN	Site address conflict, rejecting sites	{"address": "app.example.com", "policy": "reject", "sources": ["container team-b", "container team-a"], "rejected": ["container team-b", "container team-a"]}` + newLine
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.SiteConflictPolicy = config.SiteConflictReject
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestSiteConflicts_OwnerLabel(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		conflictingContainer("team-a-web", "172.17.0.2", 50, map[string]string{SiteOwnerLabel: "team-a"}),
+		conflictingContainer("team-a-api", "172.17.0.3", 100, map[string]string{SiteOwnerLabel: "team-a"}),
+		conflictingContainer("team-b", "172.17.0.4", 150, map[string]string{SiteOwnerLabel: "team-b"}),
+	}
+
+	const expectedCaddyfile = "app.example.com {\n" +
+		"	reverse_proxy 172.17.0.2 172.17.0.3\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Site address conflict, rejecting sites	{"address": "app.example.com", "policy": "owner-label", "sources": ["container team-a-web", "container team-a-api", "container team-b"], "rejected": ["container team-b"]}` + newLine
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.SiteConflictPolicy = config.SiteConflictOwnerLabel
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestSiteConflicts_ComposeReplicasDontConflict(t *testing.T) {
+	composeLabels := map[string]string{
+		"com.docker.compose.project": "project",
+		"com.docker.compose.service": "web",
+	}
+
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		conflictingContainer("project-web-1", "172.17.0.2", 100, composeLabels),
+		conflictingContainer("project-web-2", "172.17.0.3", 50, composeLabels),
+	}
+
+	const expectedCaddyfile = "app.example.com {\n" +
+		"	reverse_proxy 172.17.0.2 172.17.0.3\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.SiteConflictPolicy = config.SiteConflictReject
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestSiteConflicts_MergeConflictingDirectives(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		conflictingContainer("team-a", "172.17.0.2", 100, map[string]string{
+			fmtLabel("%s.tls"):    "internal",
+			fmtLabel("%s.encode"): "gzip",
+		}),
+		conflictingContainer("team-b", "172.17.0.3", 50, map[string]string{
+			fmtLabel("%s.tls"):    "admin@example.com",
+			fmtLabel("%s.encode"): "gzip",
+		}),
+	}
+
+	const expectedCaddyfile = "app.example.com {\n" +
+		"	encode gzip\n" +
+		"	reverse_proxy 172.17.0.2 172.17.0.3\n" +
+		"	tls internal\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`INFO	Site address conflict, merging sites	{"address": "app.example.com", "policy": "merge", "sources": ["container team-b", "container team-a"]}` + newLine +
+		`WARN	Conflicting directive, keeping first definition	{"path": ["app.example.com"], "kept": "tls internal\n", "kept_sources": ["container team-a"], "rejected": "tls admin@example.com\n", "rejected_sources": ["container team-b"]}` + newLine
+
+	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
+}
+
+func TestSiteConflicts_TrustedSourcesWin(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ConfigsData = []swarm.Config{
+		{
+			ID: "CONFIG-ID",
+			Spec: swarm.ConfigSpec{
+				Annotations: swarm.Annotations{
+					Name: "platform",
+					Labels: map[string]string{
+						fmtLabel("%s"): "",
+					},
+				},
+				Data: []byte(
+					"https://app.example.com {\n" +
+						"	respond maintenance\n" +
+						"}\n",
+				),
+			},
+		},
+	}
+	dockerClient.ContainersData = []container.Summary{
+		conflictingContainer("team-a", "172.17.0.2", 100, map[string]string{
+			fmtLabel("%s"): "app.example.com:443, other.example.com",
+		}),
+	}
+
+	const expectedCaddyfile = "https://app.example.com {\n" +
+		"	respond maintenance\n" +
+		"}\n" +
+		"other.example.com {\n" +
+		"	reverse_proxy 172.17.0.2\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Site address conflict, rejecting sites	{"address": "app.example.com", "policy": "first-wins", "sources": ["config platform", "container team-a"], "rejected": ["container team-a"]}` + newLine
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.SiteConflictPolicy = config.SiteConflictFirstWins
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestSiteConflicts_NormalizesAddresses(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		conflictingContainer("team-a", "172.17.0.2", 100, map[string]string{
+			fmtLabel("%s"): "http://App.example.com",
+		}),
+		conflictingContainer("team-b", "172.17.0.3", 50, nil),
+	}
+
+	const expectedCaddyfile = "app.example.com {\n" +
+		"	reverse_proxy 172.17.0.3\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Site address conflict, rejecting sites	{"address": "app.example.com", "policy": "first-wins", "sources": ["container team-b", "container team-a"], "rejected": ["container team-a"]}` + newLine
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.SiteConflictPolicy = config.SiteConflictFirstWins
+	}, expectedCaddyfile, expectedLogs)
+}
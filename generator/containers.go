@@ -1,27 +1,131 @@
 package generator
 
 import (
+	"net"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/lucaslorentz/caddy-docker-proxy/v2/caddyfile"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
 	"github.com/moby/moby/api/types/container"
 	"go.uber.org/zap"
 )
 
-func (g *CaddyfileGenerator) getContainerCaddyfile(container *container.Summary, logger *zap.Logger) (*caddyfile.Container, error) {
+const composeServiceLabel = "com.docker.compose.service"
+const swarmServiceNameLabel = "com.docker.swarm.service.name"
+
+func (g *CaddyfileGenerator) getContainerCaddyfile(clientIndex int, container *container.Summary, logger *zap.Logger) (*caddyfile.Container, error) {
 	caddyLabels := g.filterLabels(container.Labels)
 
-	return labelsToCaddyfile(caddyLabels, container, func() ([]string, error) {
-		return g.getContainerIPAddresses(container, logger, true)
-	})
+	getTargets := func(options upstreamsOptions) ([]string, error) {
+		mode := g.getUpstreamsMode(container.Labels, logger)
+		if options.dynamic {
+			ips, err := g.getContainerIPAddresses(container, logger, true)
+			g.addDynamicUpstreams(containerSelector(container), ips)
+			return dynamicUpstreamsArgs(containerSelector(container), options.port), err
+		}
+		if options.hostname || mode == config.UpstreamsHostname {
+			return g.getContainerHostnames(container, options.hostnameKind, options.port, logger)
+		}
+		if mode == config.UpstreamsPublished {
+			return g.getContainerPublishedAddresses(clientIndex, container, options.port, logger)
+		}
+		ips, err := g.getContainerIPAddresses(container, logger, true)
+		return withPort(ips, options.port), err
+	}
+
+	caddyfileBlock, err := labelsToCaddyfile(caddyLabels, container, getTargets)
+	if err == nil && g.options.TraefikLabels {
+		err = g.addTraefikCaddyfile(caddyfileBlock, container.Labels, containerSource(container), getTargets, logger)
+	}
+	if err == nil && g.options.NginxProxyEnv {
+		err = g.addVirtualHostCaddyfile(clientIndex, caddyfileBlock, container, logger)
+	}
+	if caddyfileBlock != nil {
+		caddyfileBlock.SetSource(containerSource(container))
+	}
+	return caddyfileBlock, withLabelSource(err, containerSource(container))
+}
+
+// containerSource describes a container as the source of caddyfile blocks
+func containerSource(container *container.Summary) string {
+	return "container " + containerName(container)
+}
+
+// getContainerHostnames returns the DNS name of a container of the requested kind.
+// By default, the container name is used, as compose service names can resolve
+// to containers of other projects sharing the network.
+func (g *CaddyfileGenerator) getContainerHostnames(container *container.Summary, kind string, port int, logger *zap.Logger) ([]string, error) {
+	// Only used to warn about containers caddy can't reach
+	_, err := g.getContainerIPAddresses(container, logger, true)
+	if err != nil {
+		return nil, err
+	}
+
+	hostnames := []string{}
+	composeService := container.Labels[composeServiceLabel]
+	swarmService := container.Labels[swarmServiceNameLabel]
+
+	switch kind {
+	case hostnameAlias:
+		hostnames = g.getContainerAliases(container)
+	case hostnameService:
+		if composeService != "" {
+			hostnames = append(hostnames, composeService)
+		} else if swarmService != "" {
+			hostnames = append(hostnames, swarmService)
+		}
+	case hostnameTasks:
+		if swarmService != "" {
+			hostnames = append(hostnames, "tasks."+swarmService)
+		}
+	}
+	if len(hostnames) == 0 {
+		hostnames = append(hostnames, containerName(container))
+	}
+
+	return withPort(hostnames, port), nil
+}
+
+// getContainerAliases returns the network aliases of a container in its ingress
+// networks, excluding the ones docker derives from the container name and ID
+func (g *CaddyfileGenerator) getContainerAliases(container *container.Summary) []string {
+	networksFromLabel, overrideNetwork := parseIngressNetworkLabel(container.Labels)
+	name := containerName(container)
+	aliases := []string{}
+	seen := map[string]bool{}
+
+	for networkName, network := range container.NetworkSettings.Networks {
+		if overrideNetwork {
+			if !networksFromLabel[networkName] && !networksFromLabel[network.NetworkID] {
+				continue
+			}
+		} else if !g.ingressNetworks[network.NetworkID] && !g.ingressNetworks[networkName] {
+			continue
+		}
+		for _, alias := range append(slices.Clone(network.Aliases), network.DNSNames...) {
+			if alias == name || alias == "" || strings.HasPrefix(container.ID, alias) || seen[alias] {
+				continue
+			}
+			seen[alias] = true
+			aliases = append(aliases, alias)
+		}
+	}
+
+	sort.Strings(aliases)
+	if len(aliases) > 1 {
+		aliases = aliases[:1]
+	}
+	return aliases
 }
 
 func (g *CaddyfileGenerator) getContainerIPAddresses(container *container.Summary, logger *zap.Logger, onlyIngressIps bool) ([]string, error) {
 	ips := []string{}
 	inIngressNetwork := false
 
-	ingressNetworkFromLabel, overrideNetwork := container.Labels[IngressNetworkLabel]
+	networksFromLabel, overrideNetwork := parseIngressNetworkLabel(container.Labels)
 
 	for networkName, network := range container.NetworkSettings.Networks {
 		include := false
@@ -29,16 +133,14 @@ func (g *CaddyfileGenerator) getContainerIPAddresses(container *container.Summar
 		if !onlyIngressIps {
 			include = true
 		} else if overrideNetwork {
-			include = networkName == ingressNetworkFromLabel
+			include = networksFromLabel[networkName] || networksFromLabel[network.NetworkID]
 		} else {
 			include = g.ingressNetworks[network.NetworkID] || g.ingressNetworks[networkName]
 		}
 
 		if include {
 			inIngressNetwork = true
-			if network.IPAddress.IsValid() {
-				ips = append(ips, network.IPAddress.String())
-			}
+			ips = append(ips, addressesToStrings(g.selectAddresses(network.IPAddress, network.GlobalIPv6Address))...)
 		}
 	}
 
@@ -49,16 +151,73 @@ func (g *CaddyfileGenerator) getContainerIPAddresses(container *container.Summar
 			networks = append(networks, networkName)
 		}
 		sort.Strings(networks)
-		logger.Warn("Container is not in same network as caddy",
-			zap.String("container", containerName(container)),
-			zap.Strings("container networks", networks),
-			zap.Strings("ingress networks", g.options.IngressNetworks),
-		)
+		if overrideNetwork {
+			logger.Warn("Container is not in any network listed in "+IngressNetworkLabel,
+				zap.String("container", containerName(container)),
+				zap.Strings("container networks", networks),
+				zap.Strings("label networks", sortedKeys(networksFromLabel)),
+			)
+		} else {
+			logger.Warn("Container is not in same network as caddy",
+				zap.String("container", containerName(container)),
+				zap.Strings("container networks", networks),
+				zap.Strings("ingress networks", g.options.IngressNetworks),
+			)
+		}
 	}
 
 	return ips, nil
 }
 
+// getContainerPublishedAddresses returns the docker host address with the host ports
+// published by the container. When port isn't zero, only the host port published for
+// that container port is used.
+func (g *CaddyfileGenerator) getContainerPublishedAddresses(clientIndex int, container *container.Summary, port int, logger *zap.Logger) ([]string, error) {
+	hostAddress := g.getDockerHostAddress(clientIndex)
+	addresses := []string{}
+	seen := map[string]bool{}
+
+	for _, portSummary := range container.Ports {
+		if portSummary.PublicPort == 0 || (portSummary.Type != "" && portSummary.Type != "tcp") {
+			continue
+		}
+		if port != 0 && int(portSummary.PrivatePort) != port {
+			continue
+		}
+		host := hostAddress
+		if portSummary.IP.IsValid() && !portSummary.IP.IsUnspecified() {
+			if portSummary.IP.IsLoopback() {
+				continue
+			}
+			host = portSummary.IP.String()
+		}
+		if host == "" {
+			continue
+		}
+		address := net.JoinHostPort(host, strconv.Itoa(int(portSummary.PublicPort)))
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+
+	if len(addresses) == 0 {
+		if hostAddress == "" {
+			logger.Warn("Docker host address is unknown, configure it to proxy published ports",
+				zap.String("container", containerName(container)),
+				zap.String("DockerSocket", g.getDockerSocket(clientIndex)),
+			)
+		} else {
+			logger.Warn("Container has no published port to proxy",
+				zap.String("container", containerName(container)),
+				zap.Int("port", port),
+			)
+		}
+	}
+
+	return addresses, nil
+}
+
 // containerName returns a human-friendly container name (without Docker's
 // leading slash), falling back to the container ID.
 func containerName(container *container.Summary) string {
@@ -40,6 +40,37 @@ func TestContainers_TemplateData(t *testing.T) {
 	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
 }
 
+func TestContainers_LabelErrorNamesLabelAndContainer(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		{
+			ID: "CONTAINER-ID",
+			Names: []string{
+				"/web-1",
+			},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": {
+						IPAddress: netip.MustParseAddr("172.17.0.2"),
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s"):               "service.testdomain.com",
+				fmtLabel("%s.reverse_proxy"): "{{upstreams 80",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "# Empty caddyfile"
+
+	const expectedLogs = commonLogs +
+		`ERROR	Failed to get Container Caddyfile	{"container": "CONTAINER-ID", "error": "caddy.reverse_proxy on container web-1: template: :1: unclosed action"}` + newLine
+
+	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
+}
+
 func TestContainers_PicksRightNetwork(t *testing.T) {
 	dockerClient := createBasicDockerClientMock()
 	dockerClient.ContainersData = []container.Summary{
@@ -242,6 +273,76 @@ func TestContainers_OverrideIngressNetworks(t *testing.T) {
 	}, expectedCaddyfile, expectedLogs)
 }
 
+func TestContainers_OverrideMultipleIngressNetworks(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		{
+			ID: "CONTAINER-ID",
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": {
+						IPAddress: netip.MustParseAddr("172.17.0.2"),
+						NetworkID: caddyNetworkID,
+					},
+					"other-network": {
+						IPAddress: netip.MustParseAddr("10.0.0.1"),
+						NetworkID: "other-network-id",
+					},
+					"another-network": {
+						IPAddress: netip.MustParseAddr("10.0.0.2"),
+						NetworkID: "another-network-id",
+					},
+				},
+			},
+			Labels: map[string]string{
+				"caddy_ingress_network":      "other-network, another-network-id",
+				fmtLabel("%s"):               "service.testdomain.com",
+				fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"	reverse_proxy 10.0.0.1 10.0.0.2\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs
+
+	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
+}
+
+func TestContainers_OverrideIngressNetworksNotAttached(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		{
+			ID:    "CONTAINER-ID",
+			Names: []string{"/container"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": {
+						IPAddress: netip.MustParseAddr("172.17.0.2"),
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"caddy_ingress_network":      "other-network,another-network",
+				fmtLabel("%s"):               "service.testdomain.com",
+				fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"	reverse_proxy\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Container is not in any network listed in caddy_ingress_network	{"container": "container", "container networks": ["caddy-network"], "label networks": ["another-network", "other-network"]}` + newLine
+
+	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
+}
+
 func TestContainers_Replicas(t *testing.T) {
 	dockerClient := createBasicDockerClientMock()
 	dockerClient.ContainersData = []container.Summary{
@@ -444,3 +545,259 @@ func TestContainers_WithSnippets(t *testing.T) {
 
 	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
 }
+
+func TestContainers_PublishedUpstreams(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		{
+			ID:    "CONTAINER-ID",
+			Names: []string{"/published"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"bridge": {
+						IPAddress: netip.MustParseAddr("172.18.0.2"),
+						NetworkID: "bridge-id",
+					},
+				},
+			},
+			Ports: []container.PortSummary{
+				{IP: netip.MustParseAddr("0.0.0.0"), PrivatePort: 80, PublicPort: 32768, Type: "tcp"},
+				{IP: netip.MustParseAddr("::"), PrivatePort: 80, PublicPort: 32768, Type: "tcp"},
+				{IP: netip.MustParseAddr("0.0.0.0"), PrivatePort: 8080, PublicPort: 32769, Type: "tcp"},
+				{IP: netip.MustParseAddr("127.0.0.1"), PrivatePort: 9000, PublicPort: 32770, Type: "tcp"},
+				{PrivatePort: 9090, Type: "tcp"},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s"):                 "service.testdomain.com",
+				fmtLabel("%s.0_reverse_proxy"): "{{upstreams}}",
+				fmtLabel("%s.1_reverse_proxy"): "/api* {{upstreams http 8080}}",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"	reverse_proxy 10.1.0.1:32768 10.1.0.1:32769\n" +
+		"	reverse_proxy /api* http://10.1.0.1:32769\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.DockerSockets = []string{"tcp://10.1.0.1:2376"}
+		options.UpstreamsMode = config.UpstreamsPublished
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestContainers_PublishedUpstreamsLabel(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		{
+			ID:    "CONTAINER-ID",
+			Names: []string{"/published"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{},
+			},
+			Ports: []container.PortSummary{
+				{IP: netip.MustParseAddr("0.0.0.0"), PrivatePort: 80, PublicPort: 32768, Type: "tcp"},
+			},
+			Labels: map[string]string{
+				"caddy_upstreams_mode":       "published",
+				fmtLabel("%s"):               "service.testdomain.com",
+				fmtLabel("%s.reverse_proxy"): "{{upstreams 80}}",
+			},
+		},
+		{
+			ID:    "UNPUBLISHED-ID",
+			Names: []string{"/unpublished"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{},
+			},
+			Labels: map[string]string{
+				"caddy_upstreams_mode":       "published",
+				fmtLabel("%s"):               "unpublished.testdomain.com",
+				fmtLabel("%s.reverse_proxy"): "{{upstreams 80}}",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"	reverse_proxy docker-host:32768\n" +
+		"}\n" +
+		"unpublished.testdomain.com {\n" +
+		"	reverse_proxy\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Container has no published port to proxy	{"container": "unpublished", "port": 80}` + newLine
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.DockerHostsAddress = []string{"docker-host"}
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestContainers_IPFamilies(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		{
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": {
+						IPAddress:         netip.MustParseAddr("172.17.0.2"),
+						GlobalIPv6Address: netip.MustParseAddr("fd00::2"),
+						NetworkID:         caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s"):                 "service.testdomain.com",
+				fmtLabel("%s.0_reverse_proxy"): "{{upstreams}}",
+				fmtLabel("%s.1_reverse_proxy"): "/api* {{upstreams https 8080}}",
+			},
+		},
+	}
+
+	expectedCaddyfiles := map[config.IPFamily]string{
+		config.IPv4: "service.testdomain.com {\n" +
+			"	reverse_proxy 172.17.0.2\n" +
+			"	reverse_proxy /api* https://172.17.0.2:8080\n" +
+			"}\n",
+		config.IPv6: "service.testdomain.com {\n" +
+			"	reverse_proxy [fd00::2]\n" +
+			"	reverse_proxy /api* https://[fd00::2]:8080\n" +
+			"}\n",
+		config.IPBoth: "service.testdomain.com {\n" +
+			"	reverse_proxy 172.17.0.2 [fd00::2]\n" +
+			"	reverse_proxy /api* https://172.17.0.2:8080 https://[fd00::2]:8080\n" +
+			"}\n",
+		config.IPPreferV6: "service.testdomain.com {\n" +
+			"	reverse_proxy [fd00::2]\n" +
+			"	reverse_proxy /api* https://[fd00::2]:8080\n" +
+			"}\n",
+	}
+
+	for family, expectedCaddyfile := range expectedCaddyfiles {
+		testGeneration(t, dockerClient, func(options *config.Options) {
+			options.UpstreamsIPFamily = family
+		}, expectedCaddyfile, commonLogs)
+	}
+}
+
+func TestContainers_HostnameUpstreams(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		{
+			ID:    "CONTAINER-ID",
+			Names: []string{"/project-web-1"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": {
+						IPAddress: netip.MustParseAddr("172.17.0.2"),
+						NetworkID: caddyNetworkID,
+						DNSNames:  []string{"project-web-1", "CONTAINER", "web-alias"},
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.service":   "web",
+				fmtLabel("%s"):                 "service.testdomain.com",
+				fmtLabel("%s.0_reverse_proxy"): "{{upstreams 80}}",
+				fmtLabel("%s.1_reverse_proxy"): "/name* {{upstreams (hostname \"name\") 80}}",
+				fmtLabel("%s.2_reverse_proxy"): "/alias* {{upstreams https (hostname \"alias\")}}",
+				fmtLabel("%s.3_reverse_proxy"): "/service* {{upstreams (hostname \"service\") 80}}",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"	reverse_proxy project-web-1:80\n" +
+		"	reverse_proxy /name* project-web-1:80\n" +
+		"	reverse_proxy /alias* https://web-alias\n" +
+		"	reverse_proxy /service* web:80\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.UpstreamsMode = config.UpstreamsHostname
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestContainers_RawLabelsAreMerged(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		createContainer("web", "172.17.0.2", map[string]string{
+			fmtLabel("%s"):     "example.com",
+			fmtLabel("%s.raw"): "@api path /api/*\nreverse_proxy @api {{upstreams 8080}}",
+		}),
+		createContainer("api", "172.17.0.3", map[string]string{
+			fmtLabel("%s"):     "example.com",
+			fmtLabel("%s.raw"): "@api path /api/*\nreverse_proxy @api {{upstreams 8080}}",
+		}),
+	}
+
+	const expectedCaddyfile = "example.com {\n" +
+		"	@api path /api/*\n" +
+		"	reverse_proxy @api 172.17.0.2:8080 172.17.0.3:8080\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`INFO	Site address conflict, merging sites	{"address": "example.com", "policy": "merge", "sources": ["container api", "container web"]}` + newLine
+
+	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
+}
+
+func TestContainers_InvalidRawLabel(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		createContainer("web", "172.17.0.2", map[string]string{
+			fmtLabel("%s"):     "example.com",
+			fmtLabel("%s.raw"): "respond 200\n}",
+		}),
+	}
+
+	const expectedCaddyfile = "# Empty caddyfile"
+
+	const expectedLogs = commonLogs +
+		`ERROR	Failed to get Container Caddyfile	{"container": "web", "error": "caddy.raw on container web: Unexpected token '}' at line 2, column 1"}` + newLine
+
+	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
+}
+
+func TestContainers_IsolatedBlocksAreNotMerged(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		createContainer("web", "172.17.0.2", map[string]string{
+			fmtLabel("%s"):                 "example.com",
+			fmtLabel("%s.route_0.respond"): "/a 200",
+			fmtLabel("%s.route_1.respond"): "/b 404",
+		}),
+		createContainer("api", "172.17.0.3", map[string]string{
+			fmtLabel("%s"):                     "example.com",
+			fmtLabel("%s.route.reverse_proxy"): "{{upstreams}}",
+			fmtLabel("%s.handle_0.respond"):    "/c 200",
+			fmtLabel("%s.handle_1.respond"):    "/d 404",
+		}),
+	}
+
+	// Blocks of other containers are merged into the first isolated block
+	const expectedCaddyfile = "example.com {\n" +
+		"	handle {\n" +
+		"		respond /c 200\n" +
+		"	}\n" +
+		"	handle {\n" +
+		"		respond /d 404\n" +
+		"	}\n" +
+		"	route {\n" +
+		"		respond /a 200\n" +
+		"		reverse_proxy 172.17.0.3\n" +
+		"	}\n" +
+		"	route {\n" +
+		"		respond /b 404\n" +
+		"	}\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`INFO	Site address conflict, merging sites	{"address": "example.com", "policy": "merge", "sources": ["container api", "container web"]}` + newLine
+
+	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
+}
@@ -0,0 +1,82 @@
+package generator
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/swarm"
+)
+
+const composeProjectLabel = "com.docker.compose.project"
+
+// UpstreamsIndex holds the upstream hosts of the docker resources referenced by
+// dynamic upstreams, refreshed on every generation cycle. It is safe for
+// concurrent use, so Caddy can resolve upstreams from it at request time.
+type UpstreamsIndex struct {
+	mutex     sync.RWMutex
+	upstreams map[string][]string
+}
+
+// Get returns the upstream hosts of the docker resources matching a selector
+func (index *UpstreamsIndex) Get(selector string) []string {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	return index.upstreams[selector]
+}
+
+func (index *UpstreamsIndex) set(upstreams map[string][]string) {
+	for selector, hosts := range upstreams {
+		sort.Strings(hosts)
+		upstreams[selector] = hosts
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.upstreams = upstreams
+}
+
+// UpstreamsIndex returns the index used by dynamic docker upstreams
+func (g *CaddyfileGenerator) UpstreamsIndex() *UpstreamsIndex {
+	return g.upstreamsIndex
+}
+
+// addDynamicUpstreams registers upstream hosts for a selector in the current
+// cycle. Hosts are stored without brackets, IPv6 ones included, as they are
+// joined with the port when resolved.
+func (g *CaddyfileGenerator) addDynamicUpstreams(selector string, hosts []string) {
+	if _, exists := g.dynamicUpstreams[selector]; !exists {
+		g.dynamicUpstreams[selector] = []string{}
+	}
+	for _, host := range hosts {
+		if !slices.Contains(g.dynamicUpstreams[selector], host) {
+			g.dynamicUpstreams[selector] = append(g.dynamicUpstreams[selector], host)
+		}
+	}
+}
+
+// dynamicUpstreamsArgs returns the dynamic upstream source arguments for a selector
+func dynamicUpstreamsArgs(selector string, port int) []string {
+	args := "docker " + selector
+	if port != 0 {
+		args += " " + strconv.Itoa(port)
+	}
+	return []string{args}
+}
+
+// containerSelector identifies a container, or all replicas of a compose service,
+// in the upstreams index
+func containerSelector(container *container.Summary) string {
+	project := container.Labels[composeProjectLabel]
+	service := container.Labels[composeServiceLabel]
+	if project != "" && service != "" {
+		return "compose/" + project + "/" + service
+	}
+	return "container/" + containerName(container)
+}
+
+// serviceSelector identifies a swarm service in the upstreams index
+func serviceSelector(service *swarm.Service) string {
+	return "service/" + service.Spec.Name
+}
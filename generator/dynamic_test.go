@@ -0,0 +1,119 @@
+package generator
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/docker"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/network"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDynamicUpstreams(t *testing.T) {
+	composeContainer := func(id string, ip string) container.Summary {
+		return container.Summary{
+			ID:    id,
+			Names: []string{"/project-web-" + id},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": {
+						IPAddress: netip.MustParseAddr(ip),
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				"com.docker.compose.project":         "project",
+				"com.docker.compose.service":         "web",
+				fmtLabel("%s"):                       "web.testdomain.com",
+				fmtLabel("%s.reverse_proxy.dynamic"): "{{upstreams dynamic 8080}}",
+			},
+		}
+	}
+
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		composeContainer("1", "172.17.0.3"),
+		composeContainer("2", "172.17.0.2"),
+		{
+			ID:    "3",
+			Names: []string{"/standalone"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": {
+						IPAddress: netip.MustParseAddr("172.17.0.4"),
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s"):                       "standalone.testdomain.com",
+				fmtLabel("%s.reverse_proxy.dynamic"): "{{upstreams dynamic}}",
+			},
+		},
+	}
+
+	options := &config.Options{
+		LabelPrefix: DefaultLabelPrefix,
+	}
+
+	generator := CreateGenerator([]docker.Client{dockerClient}, createDockerUtilsMock(), options)
+
+	caddyfileBytes, _ := generator.GenerateCaddyfile(zap.NewNop())
+
+	const expectedCaddyfile = "standalone.testdomain.com {\n" +
+		"	reverse_proxy {\n" +
+		"		dynamic docker container/standalone\n" +
+		"	}\n" +
+		"}\n" +
+		"web.testdomain.com {\n" +
+		"	reverse_proxy {\n" +
+		"		dynamic docker compose/project/web 8080\n" +
+		"	}\n" +
+		"}\n"
+
+	assert.Equal(t, expectedCaddyfile, string(caddyfileBytes))
+	assert.Equal(t, []string{"172.17.0.2", "172.17.0.3"}, generator.UpstreamsIndex().Get("compose/project/web"))
+	assert.Equal(t, []string{"172.17.0.4"}, generator.UpstreamsIndex().Get("container/standalone"))
+
+	// Containers removed in the next cycle are removed from the index
+	dockerClient.ContainersData = dockerClient.ContainersData[:1]
+	generator.GenerateCaddyfile(zap.NewNop())
+	assert.Equal(t, []string{"172.17.0.3"}, generator.UpstreamsIndex().Get("compose/project/web"))
+	assert.Nil(t, generator.UpstreamsIndex().Get("container/standalone"))
+}
+
+func TestDynamicUpstreams_IPv6(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		{
+			ID:    "1",
+			Names: []string{"/ipv6"},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": {
+						GlobalIPv6Address: netip.MustParseAddr("fd00::1"),
+						NetworkID:         caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s"):                       "ipv6.testdomain.com",
+				fmtLabel("%s.reverse_proxy.dynamic"): "{{upstreams dynamic 8080}}",
+			},
+		},
+	}
+
+	options := &config.Options{
+		LabelPrefix:       DefaultLabelPrefix,
+		UpstreamsIPFamily: config.IPv6,
+	}
+
+	generator := CreateGenerator([]docker.Client{dockerClient}, createDockerUtilsMock(), options)
+	generator.GenerateCaddyfile(zap.NewNop())
+
+	assert.Equal(t, []string{"fd00::1"}, generator.UpstreamsIndex().Get("container/ipv6"))
+}
@@ -1,10 +1,10 @@
 package generator
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
@@ -22,10 +22,22 @@ import (
 // DefaultLabelPrefix for caddy labels in docker
 const DefaultLabelPrefix = "caddy"
 
+// UpstreamsModeLabel overrides, per container or service, the upstreams mode
+const UpstreamsModeLabel = "caddy_upstreams_mode"
+
+// IngressNetworkLabel overrides, per container or service, the comma separated
+// networks used to reach it
 const IngressNetworkLabel = "caddy_ingress_network"
 
+// SiteOwnerLabel identifies, per container or service, who owns its sites, so
+// sites with the same address are merged when their owners match, with the
+// owner-label site conflict policy
+const SiteOwnerLabel = "caddy_site_owner"
+
 const swarmAvailabilityCacheInterval = 1 * time.Minute
 
+var isTrue = regexp.MustCompile("(?i)^(true|yes|1)$")
+
 // CaddyfileGenerator generates caddyfile from docker configuration
 type CaddyfileGenerator struct {
 	options              *config.Options
@@ -35,6 +47,19 @@ type CaddyfileGenerator struct {
 	ingressNetworks      map[string]bool
 	swarmIsAvailable     []bool
 	swarmIsAvailableTime time.Time
+	networksCache        *networksCache
+	networkNames         map[string]string
+	serviceTasks         []*serviceTasksIndex
+	dynamicUpstreams     map[string][]string
+	upstreamsIndex       *UpstreamsIndex
+	labelsPolicy         *LabelsPolicy
+	rules                *loadedRules
+	ruleHits             map[string]int64
+	apiCalls             map[string]int
+	// containerEnvs are the environment variables of the containers listed in
+	// the current cycle, and previousContainerEnvs the ones of the previous cycle
+	containerEnvs         map[string]map[string]string
+	previousContainerEnvs map[string]map[string]string
 }
 
 // CreateGenerator creates a new generator
@@ -47,19 +72,29 @@ func CreateGenerator(dockerClients []docker.Client, dockerUtils docker.Utils, op
 		dockerClients:    dockerClients,
 		swarmIsAvailable: make([]bool, len(dockerClients)),
 		dockerUtils:      dockerUtils,
+		networksCache:    newNetworksCache(len(dockerClients)),
+		networkNames:     map[string]string{},
+		apiCalls:         map[string]int{},
+		upstreamsIndex:   &UpstreamsIndex{},
+		ruleHits:         map[string]int64{},
 	}
 }
 
 // GenerateCaddyfile generates a caddy file config from docker metadata
 func (g *CaddyfileGenerator) GenerateCaddyfile(logger *zap.Logger) ([]byte, []string) {
-	var caddyfileBuffer bytes.Buffer
+	g.resetCycleState()
 
+	autoAttachNetworks := g.options.AutoAttachNetworks
 	ingressNetworks, err := g.getIngressNetworks(logger)
-	if err == nil {
-		g.ingressNetworks = ingressNetworks
-	} else {
+	if err != nil {
 		logger.Error("Failed to get ingress networks", zap.Error(err))
+		// Attaching with partial ingress networks would attach everything again
+		if autoAttachNetworks {
+			logger.Warn("Skipping ingress network attachment because ingress networks are unknown")
+			autoAttachNetworks = false
+		}
 	}
+	g.ingressNetworks = ingressNetworks
 
 	if time.Since(g.swarmIsAvailableTime) > swarmAvailabilityCacheInterval {
 		g.checkSwarmAvailability(logger, time.Time.IsZero(g.swarmIsAvailableTime))
@@ -67,6 +102,7 @@ func (g *CaddyfileGenerator) GenerateCaddyfile(logger *zap.Logger) ([]byte, []st
 	}
 
 	caddyfileBlock := caddyfile.CreateContainer()
+	sourceCaddyfiles := []*sourceCaddyfile{}
 	controlledServers := []string{}
 
 	// Add caddyfile from path
@@ -79,7 +115,8 @@ func (g *CaddyfileGenerator) GenerateCaddyfile(logger *zap.Logger) ([]byte, []st
 			if err != nil {
 				logger.Error("Failed to parse Caddyfile", zap.String("path", g.options.CaddyfilePath), zap.Error(err))
 			} else {
-				caddyfileBlock.Merge(block)
+				block.SetSource("file " + g.options.CaddyfilePath)
+				sourceCaddyfiles = append(sourceCaddyfiles, &sourceCaddyfile{caddyfile: block, source: "file " + g.options.CaddyfilePath})
 			}
 		}
 	} else {
@@ -90,10 +127,12 @@ func (g *CaddyfileGenerator) GenerateCaddyfile(logger *zap.Logger) ([]byte, []st
 
 		// Add Caddyfile from swarm configs
 		if g.swarmIsAvailable[i] {
+			g.countAPICall("ConfigList")
 			configs, err := dockerClient.ConfigList(context.Background(), client.ConfigListOptions{})
 			if err == nil {
 				for _, config := range configs {
 					if _, hasLabel := config.Spec.Labels[g.options.LabelPrefix]; hasLabel {
+						g.countAPICall("ConfigInspect")
 						fullConfig, _, err := dockerClient.ConfigInspectWithRaw(context.Background(), config.ID)
 						if err != nil {
 							logger.Error("Failed to inspect Swarm Config", zap.String("config", config.Spec.Name), zap.Error(err))
@@ -103,7 +142,8 @@ func (g *CaddyfileGenerator) GenerateCaddyfile(logger *zap.Logger) ([]byte, []st
 							if err != nil {
 								logger.Error("Failed to parse Swarm Config caddyfile format", zap.String("config", config.Spec.Name), zap.Error(err))
 							} else {
-								caddyfileBlock.Merge(block)
+								block.SetSource("config " + config.Spec.Name)
+								sourceCaddyfiles = append(sourceCaddyfiles, &sourceCaddyfile{caddyfile: block, source: "config " + config.Spec.Name})
 							}
 						}
 					}
@@ -116,6 +156,7 @@ func (g *CaddyfileGenerator) GenerateCaddyfile(logger *zap.Logger) ([]byte, []st
 		}
 
 		// Add containers
+		g.countAPICall("ContainerList")
 		containers, err := dockerClient.ContainerList(context.Background(), client.ContainerListOptions{All: g.options.ScanStoppedContainers})
 		if err == nil {
 			for _, container := range containers {
@@ -131,9 +172,19 @@ func (g *CaddyfileGenerator) GenerateCaddyfile(logger *zap.Logger) ([]byte, []st
 						}
 					}
 				}
-				containerCaddyfile, err := g.getContainerCaddyfile(&container, logger)
+				if autoAttachNetworks {
+					g.attachContainerToIngressNetwork(dockerClient, &container, logger)
+				}
+				containerCaddyfile, err := g.getContainerCaddyfile(i, &container, logger)
 				if err == nil {
-					caddyfileBlock.Merge(containerCaddyfile)
+					sourceCaddyfiles = append(sourceCaddyfiles, &sourceCaddyfile{
+						caddyfile: containerCaddyfile,
+						source:    containerSource(&container),
+						owner:     containerSelector(&container),
+						siteOwner: container.Labels[SiteOwnerLabel],
+						created:   time.Unix(container.Created, 0),
+						labels:    container.Labels,
+					})
 				} else {
 					logger.Error("Failed to get Container Caddyfile", zap.String("container", container.ID), zap.Error(err))
 				}
@@ -144,6 +195,7 @@ func (g *CaddyfileGenerator) GenerateCaddyfile(logger *zap.Logger) ([]byte, []st
 
 		// Add services
 		if g.swarmIsAvailable[i] {
+			g.countAPICall("ServiceList")
 			services, err := dockerClient.ServiceList(context.Background(), client.ServiceListOptions{})
 			if err == nil {
 				for _, service := range services {
@@ -162,10 +214,21 @@ func (g *CaddyfileGenerator) GenerateCaddyfile(logger *zap.Logger) ([]byte, []st
 						}
 					}
 
+					if autoAttachNetworks {
+						g.attachServiceToIngressNetwork(dockerClient, &service, logger)
+					}
+
 					// caddy. labels based config
-					serviceCaddyfile, err := g.getServiceCaddyfile(&service, logger)
+					serviceCaddyfile, err := g.getServiceCaddyfile(i, &service, logger)
 					if err == nil {
-						caddyfileBlock.Merge(serviceCaddyfile)
+						sourceCaddyfiles = append(sourceCaddyfiles, &sourceCaddyfile{
+							caddyfile: serviceCaddyfile,
+							source:    serviceSource(&service),
+							owner:     serviceSelector(&service),
+							siteOwner: service.Spec.Labels[SiteOwnerLabel],
+							created:   service.CreatedAt,
+							labels:    service.Spec.Labels,
+						})
 					} else {
 						logger.Error("Failed to get Swarm service caddyfile", zap.String("service", service.Spec.Name), zap.Error(err))
 					}
@@ -178,33 +241,41 @@ func (g *CaddyfileGenerator) GenerateCaddyfile(logger *zap.Logger) ([]byte, []st
 		}
 	}
 
-	// Write global blocks first
-	globalCaddyfile := caddyfile.CreateContainer()
-	for _, block := range caddyfileBlock.Children {
-		if block.IsGlobalBlock() {
-			globalCaddyfile.AddBlock(block)
-			caddyfileBlock.Remove(block)
-		}
-	}
-	caddyfileBuffer.Write(globalCaddyfile.Marshal())
+	g.upstreamsIndex.set(g.dynamicUpstreams)
 
-	// Write remaining blocks
-	caddyfileBuffer.Write(caddyfileBlock.Marshal())
+	sourceCaddyfiles = g.applyLabelsPolicy(sourceCaddyfiles, logger)
+	g.resolveSiteConflicts(sourceCaddyfiles, logger)
+	for _, sourceCaddyfile := range sourceCaddyfiles {
+		logMergeConflicts(caddyfileBlock.Merge(sourceCaddyfile.caddyfile), logger)
+	}
 
-	caddyfileContent := caddyfileBuffer.Bytes()
+	g.applyRules(caddyfileBlock, logger)
 
 	if g.options.ProcessCaddyfile {
-		processCaddyfileContent, processLogs := caddyfile.Process(caddyfileContent)
-		caddyfileContent = processCaddyfileContent
+		processedCaddyfile, processLogs := caddyfile.ProcessContainer(caddyfileBlock)
+		caddyfileBlock = processedCaddyfile
 		if len(processLogs) > 0 {
 			logger.Info("Process Caddyfile", zap.ByteString("logs", processLogs))
 		}
 	}
 
+	// Global blocks are sorted first
+	var caddyfileContent []byte
+	if g.options.CaddyfileSourceComments {
+		caddyfileContent = caddyfileBlock.MarshalWithSources()
+	} else {
+		caddyfileContent = caddyfileBlock.Marshal()
+	}
+
 	if len(caddyfileContent) == 0 {
 		caddyfileContent = []byte("# Empty caddyfile")
 	}
 
+	logger.Debug("Docker API calls", zap.Any("calls", g.apiCalls))
+	if len(g.ruleHits) > 0 {
+		logger.Debug("Rule hits", zap.Any("hits", g.ruleHits))
+	}
+
 	// controlledServers lists only the remote servers discovered from labels.
 	// The loader pushes to the local in-process Caddy itself when this instance
 	// runs in server mode, so the local target is not represented here.
@@ -212,9 +283,23 @@ func (g *CaddyfileGenerator) GenerateCaddyfile(logger *zap.Logger) ([]byte, []st
 	return caddyfileContent, controlledServers
 }
 
+// logMergeConflicts logs the single directives defined differently by merged caddyfiles
+func logMergeConflicts(conflicts []caddyfile.MergeConflict, logger *zap.Logger) {
+	for _, conflict := range conflicts {
+		logger.Warn("Conflicting directive, keeping first definition",
+			zap.Strings("path", conflict.Path),
+			zap.ByteString("kept", conflict.Kept.Marshal()),
+			zap.Strings("kept_sources", conflict.Kept.Sources),
+			zap.ByteString("rejected", conflict.Rejected.Marshal()),
+			zap.Strings("rejected_sources", conflict.Rejected.Sources),
+		)
+	}
+}
+
 func (g *CaddyfileGenerator) checkSwarmAvailability(logger *zap.Logger, isFirstCheck bool) {
 
 	for i, dockerClient := range g.dockerClients {
+		g.countAPICall("Info")
 		info, err := dockerClient.Info(context.Background())
 		if err == nil {
 			newSwarmIsAvailable := info.Swarm.LocalNodeState == swarm.LocalNodeStateActive
@@ -229,54 +314,68 @@ func (g *CaddyfileGenerator) checkSwarmAvailability(logger *zap.Logger, isFirstC
 	}
 }
 
-func (g *CaddyfileGenerator) getIngressNetworks(logger *zap.Logger) (map[string]bool, error) {
-	ingressNetworks := map[string]bool{}
+// getUpstreamsMode returns the upstreams mode of a container or service
+func (g *CaddyfileGenerator) getUpstreamsMode(labels map[string]string, logger *zap.Logger) config.UpstreamsMode {
+	if mode, hasLabel := labels[UpstreamsModeLabel]; hasLabel {
+		switch upstreamsMode := config.UpstreamsMode(strings.ToLower(strings.TrimSpace(mode))); upstreamsMode {
+		case config.UpstreamsIP, config.UpstreamsPublished, config.UpstreamsHostname:
+			return upstreamsMode
+		default:
+			logger.Warn("Ignoring invalid upstreams mode label", zap.String("mode", mode))
+		}
+	}
+	if g.options.UpstreamsMode == "" {
+		return config.UpstreamsIP
+	}
+	return g.options.UpstreamsMode
+}
 
-	for _, dockerClient := range g.dockerClients {
-		if len(g.options.IngressNetworks) > 0 {
-			networks, err := dockerClient.NetworkList(context.Background(), client.NetworkListOptions{})
-			if err != nil {
-				return nil, err
-			}
-			for _, dockerNetwork := range networks {
-				if dockerNetwork.Ingress {
-					continue
-				}
-				for _, ingressNetwork := range g.options.IngressNetworks {
-					if dockerNetwork.Name == ingressNetwork {
-						ingressNetworks[dockerNetwork.ID] = true
-						ingressNetworks[dockerNetwork.Name] = true
-					}
-				}
-			}
-		} else {
-			containerID, err := g.dockerUtils.GetCurrentContainerID()
-			if err != nil {
-				return nil, err
-			}
-			logger.Debug("Caddy ContainerID", zap.String("ID", containerID))
-			container, err := dockerClient.ContainerInspect(context.Background(), containerID)
-			if err != nil {
-				return nil, err
-			}
+// getDockerSocket returns the socket of the docker client at clientIndex, when known
+func (g *CaddyfileGenerator) getDockerSocket(clientIndex int) string {
+	if clientIndex < len(g.options.DockerSockets) {
+		return g.options.DockerSockets[clientIndex]
+	}
+	return ""
+}
 
-			for _, networkEndpoint := range container.NetworkSettings.Networks {
-				networkInfo, err := dockerClient.NetworkInspect(context.Background(), networkEndpoint.NetworkID, client.NetworkInspectOptions{})
-				if err != nil {
-					return nil, err
-				}
-				if networkInfo.Ingress {
-					continue
-				}
-				ingressNetworks[networkInfo.ID] = true
-				ingressNetworks[networkInfo.Name] = true
-			}
-		}
+// getDockerHostAddress returns the address where ports published in the docker host
+// of the client at clientIndex are reachable. It defaults to the host of TCP sockets.
+func (g *CaddyfileGenerator) getDockerHostAddress(clientIndex int) string {
+	if clientIndex < len(g.options.DockerHostsAddress) && g.options.DockerHostsAddress[clientIndex] != "" {
+		return g.options.DockerHostsAddress[clientIndex]
+	}
+	socketURL, err := url.Parse(g.getDockerSocket(clientIndex))
+	if err != nil {
+		return ""
+	}
+	switch socketURL.Scheme {
+	case "tcp", "http", "https", "ssh":
+		return socketURL.Hostname()
 	}
+	return ""
+}
 
-	logger.Debug("IngressNetworksMap", zap.String("ingress", fmt.Sprintf("%v", ingressNetworks)))
+// resetCycleState drops everything cached for the previous generation cycle
+func (g *CaddyfileGenerator) resetCycleState() {
+	g.serviceTasks = make([]*serviceTasksIndex, len(g.dockerClients))
+	g.dynamicUpstreams = map[string][]string{}
+	g.previousContainerEnvs = g.containerEnvs
+	g.containerEnvs = map[string]map[string]string{}
+	g.apiCalls = map[string]int{}
+}
 
-	return ingressNetworks, nil
+// countAPICall records a docker API call made during the current generation cycle
+func (g *CaddyfileGenerator) countAPICall(name string) {
+	g.apiCalls[name]++
+}
+
+// APICalls returns how many times each docker API was called during the last generation cycle
+func (g *CaddyfileGenerator) APICalls() map[string]int {
+	calls := make(map[string]int, len(g.apiCalls))
+	for name, count := range g.apiCalls {
+		calls[name] = count
+	}
+	return calls
 }
 
 func (g *CaddyfileGenerator) filterLabels(labels map[string]string) map[string]string {
@@ -93,6 +93,117 @@ func TestMergeConfigContent(t *testing.T) {
 	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
 }
 
+func TestMergeConfigContent_KeepsComments(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ConfigsData = []swarm.Config{
+		{
+			ID: "CONFIG-ID",
+			Spec: swarm.ConfigSpec{
+				Annotations: swarm.Annotations{
+					Labels: map[string]string{
+						fmtLabel("%s"): "",
+					},
+				},
+				Data: []byte(
+					"# Managed by the platform team\n" +
+						"example.com {\n" +
+						"	reverse_proxy 127.0.0.1 # legacy server\n" +
+						"}",
+				),
+			},
+		},
+	}
+	dockerClient.ContainersData = []container.Summary{
+		{
+			Names: []string{
+				"container-name",
+			},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": {
+						IPAddress: netip.MustParseAddr("172.17.0.2"),
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s"):               "example.com",
+				fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+				fmtLabel("%s.encode"):        "gzip",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "# Managed by the platform team\n" +
+		"example.com {\n" +
+		"	# legacy server\n" +
+		"	reverse_proxy 127.0.0.1 172.17.0.2\n" +
+		"	encode gzip\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs
+
+	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
+}
+
+func TestSourceComments(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ConfigsData = []swarm.Config{
+		{
+			ID: "CONFIG-ID",
+			Spec: swarm.ConfigSpec{
+				Annotations: swarm.Annotations{
+					Name: "caddy-config",
+					Labels: map[string]string{
+						fmtLabel("%s"): "",
+					},
+				},
+				Data: []byte(
+					"example.com {\n" +
+						"	reverse_proxy 127.0.0.1\n" +
+						"}",
+				),
+			},
+		},
+	}
+	dockerClient.ContainersData = []container.Summary{
+		{
+			Names: []string{
+				"/container-name",
+			},
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": {
+						IPAddress: netip.MustParseAddr("172.17.0.2"),
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s"):               "example.com",
+				fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+				fmtLabel("%s.encode"):        "gzip",
+				fmtLabel("%s.log.invalid"):   "",
+			},
+		},
+	}
+
+	const expectedCaddyfile = "# source: config caddy-config, container container-name\n" +
+		"example.com {\n" +
+		"	reverse_proxy 127.0.0.1 172.17.0.2\n" +
+		"	# source: container container-name\n" +
+		"	encode gzip\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`INFO	Process Caddyfile	{"logs": "[ERROR]  Removing invalid directive: parsing caddyfile tokens for 'log': unrecognized subdirective: invalid, at Caddyfile:5\n# source: config caddy-config, container container-name\nexample.com {\n\t# source: container container-name\n\tlog {\n\t\tinvalid\n\t}\n}\n\n"}` + newLine
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.ProcessCaddyfile = true
+		options.CaddyfileSourceComments = true
+	}, expectedCaddyfile, expectedLogs)
+}
+
 func TestIgnoreLabelsWithoutCaddyPrefix(t *testing.T) {
 	dockerClient := createBasicDockerClientMock()
 	dockerClient.ServicesData = []swarm.Service{
@@ -186,6 +297,23 @@ func createBasicDockerClientMock() *docker.ClientMock {
 	}
 }
 
+// createContainer creates a running container attached to the caddy network
+func createContainer(name string, ip string, labels map[string]string) container.Summary {
+	return container.Summary{
+		ID:    name,
+		Names: []string{"/" + name},
+		NetworkSettings: &container.NetworkSettingsSummary{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": {
+					IPAddress: netip.MustParseAddr(ip),
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+		Labels: labels,
+	}
+}
+
 func prefixes(values ...string) []netip.Prefix {
 	result := make([]netip.Prefix, 0, len(values))
 	for _, value := range values {
@@ -0,0 +1,46 @@
+package generator
+
+import (
+	"net/netip"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+)
+
+// selectAddresses returns the addresses of a network endpoint matching the
+// configured IP family
+func (g *CaddyfileGenerator) selectAddresses(addresses ...netip.Addr) []netip.Addr {
+	ipv4s := []netip.Addr{}
+	ipv6s := []netip.Addr{}
+	for _, address := range addresses {
+		if !address.IsValid() {
+			continue
+		}
+		if address.Unmap().Is4() {
+			ipv4s = append(ipv4s, address.Unmap())
+		} else {
+			ipv6s = append(ipv6s, address)
+		}
+	}
+
+	switch g.options.UpstreamsIPFamily {
+	case config.IPv6:
+		return ipv6s
+	case config.IPBoth:
+		return append(ipv4s, ipv6s...)
+	case config.IPPreferV6:
+		if len(ipv6s) > 0 {
+			return ipv6s
+		}
+		return ipv4s
+	default:
+		return ipv4s
+	}
+}
+
+func addressesToStrings(addresses []netip.Addr) []string {
+	values := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		values = append(values, address.String())
+	}
+	return values
+}
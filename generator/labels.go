@@ -1,6 +1,9 @@
 package generator
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"sort"
 	"strconv"
 	"strings"
@@ -9,30 +12,109 @@ import (
 	"github.com/lucaslorentz/caddy-docker-proxy/v2/caddyfile"
 )
 
-type targetsProvider func() ([]string, error)
+// targetsProvider returns the upstream addresses of a docker resource
+type targetsProvider func(options upstreamsOptions) ([]string, error)
+
+// upstreamsOptions are the upstreams template function parameters used to resolve targets
+type upstreamsOptions struct {
+	// port the targets must reach, zero when not requested
+	port int
+	// hostname requests DNS names instead of the addresses of the upstreams mode
+	hostname bool
+	// hostnameKind selects which DNS name is used, empty for the default one
+	hostnameKind string
+	// dynamic requests the arguments of a dynamic docker upstream source, resolving
+	// upstreams at request time, instead of upstream addresses
+	dynamic bool
+}
+
+// hostnameParam is the value of the hostname template function
+type hostnameParam struct {
+	kind string
+}
+
+// dynamicParam is the value of the dynamic template function
+type dynamicParam struct{}
+
+// DNS names available to the hostname template function
+const (
+	hostnameName    = "name"
+	hostnameAlias   = "alias"
+	hostnameService = "service"
+	hostnameTasks   = "tasks"
+)
 
 func labelsToCaddyfile(labels map[string]string, templateData interface{}, getTargets targetsProvider) (*caddyfile.Container, error) {
 	funcMap := sprig.TxtFuncMap()
-	funcMap["upstreams"] = func(options ...interface{}) (string, error) {
-		targets, err := getTargets()
-		sort.Strings(targets)
+	funcMap["upstreams"] = func(params ...interface{}) (string, error) {
+		protocol := ""
+		options := upstreamsOptions{}
+		for _, param := range params {
+			switch p := param.(type) {
+			case string:
+				protocol = p
+			case int:
+				options.port = p
+			case hostnameParam:
+				options.hostname = true
+				options.hostnameKind = p.kind
+			case dynamicParam:
+				options.dynamic = true
+			}
+		}
+		if options.dynamic && protocol != "" {
+			return "", fmt.Errorf("protocol %s is not supported by dynamic upstreams, configure the reverse_proxy transport instead", protocol)
+		}
+		targets, err := getTargets(options)
 		transformed := []string{}
 		for _, target := range targets {
-			for _, param := range options {
-				if protocol, isProtocol := param.(string); isProtocol {
-					target = protocol + "://" + target
-				} else if port, isPort := param.(int); isPort {
-					target = target + ":" + strconv.Itoa(port)
-				}
+			if protocol != "" {
+				target = protocol + "://" + target
 			}
 			transformed = append(transformed, target)
 		}
 		sort.Strings(transformed)
 		return strings.Join(transformed, " "), err
 	}
+	funcMap["hostname"] = func(kind ...string) (hostnameParam, error) {
+		if len(kind) == 0 {
+			return hostnameParam{}, nil
+		}
+		switch kind[0] {
+		case hostnameName, hostnameAlias, hostnameService, hostnameTasks:
+			return hostnameParam{kind: kind[0]}, nil
+		}
+		return hostnameParam{}, fmt.Errorf("invalid hostname kind %q, expected %s, %s, %s or %s", kind[0], hostnameName, hostnameAlias, hostnameService, hostnameTasks)
+	}
+	funcMap["dynamic"] = func() dynamicParam { return dynamicParam{} }
 	funcMap["http"] = func() string { return "http" }
 	funcMap["https"] = func() string { return "https" }
 	funcMap["h2c"] = func() string { return "h2c" }
 
 	return caddyfile.FromLabels(labels, templateData, funcMap)
 }
+
+// withLabelSource adds the docker resource defining the failing label to label errors
+func withLabelSource(err error, source string) error {
+	var labelErr *caddyfile.LabelError
+	if errors.As(err, &labelErr) {
+		labelErr.Source = source
+	}
+	return err
+}
+
+// withPort appends port to each host, unless port is zero. IPv6 hosts are
+// enclosed in brackets in both cases.
+func withPort(hosts []string, port int) []string {
+	targets := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if port != 0 {
+			targets = append(targets, net.JoinHostPort(host, strconv.Itoa(port)))
+		} else if strings.Contains(host, ":") {
+			targets = append(targets, "["+host+"]")
+		} else {
+			targets = append(targets, host)
+		}
+	}
+	return targets
+}
@@ -46,15 +46,15 @@ func TestLabelsToCaddyfile(t *testing.T) {
 		expectedCaddyfile = winNewlines.ReplaceAllString(expectedCaddyfile, "\n")
 
 		// convert the labels to a Caddyfile
-		caddyfileBlock, err := labelsToCaddyfile(labels, nil, func() ([]string, error) {
-			return []string{"target"}, nil
+		caddyfileBlock, err := labelsToCaddyfile(labels, nil, func(options upstreamsOptions) ([]string, error) {
+			return withPort([]string{"target"}, options.port), nil
 		})
 
 		// if the result is nil then we expect an empty Caddyfile
 		// or an error message prefixed with "err: "
 		if caddyfileBlock == nil {
 			if strings.HasPrefix(expectedCaddyfile, "err: ") {
-				assert.Error(t, err, expectedCaddyfile[4:])
+				assert.EqualError(t, err, strings.TrimPrefix(expectedCaddyfile, "err: "), "unexpected error in %s", filename)
 			} else if expectedCaddyfile != "" {
 				t.Errorf("got nil in %s but expected: %s", filename, expectedCaddyfile)
 			}
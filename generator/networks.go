@@ -0,0 +1,239 @@
+package generator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/docker"
+	"github.com/moby/moby/api/types/events"
+	"github.com/moby/moby/client"
+
+	"go.uber.org/zap"
+)
+
+// networksCache keeps the ingress networks found through each docker client
+// between generation cycles. Entries are refreshed only after being invalidated
+// by a docker network event, and a failed refresh keeps the previous entry.
+type networksCache struct {
+	mutex   sync.Mutex
+	entries []*networksCacheEntry
+}
+
+type networksCacheEntry struct {
+	ingressNetworks map[string]bool
+	stale           bool
+}
+
+func newNetworksCache(size int) *networksCache {
+	return &networksCache{
+		entries: make([]*networksCacheEntry, size),
+	}
+}
+
+// get returns the cached entry for a client and whether it must be refreshed
+func (cache *networksCache) get(clientIndex int) (*networksCacheEntry, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry := cache.entries[clientIndex]
+	return entry, entry == nil || entry.stale
+}
+
+func (cache *networksCache) set(clientIndex int, ingressNetworks map[string]bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries[clientIndex] = &networksCacheEntry{ingressNetworks: ingressNetworks}
+}
+
+func (cache *networksCache) invalidate(clientIndex int) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if entry := cache.entries[clientIndex]; entry != nil {
+		entry.stale = true
+	}
+}
+
+// InvalidateNetworks drops the cached network metadata of a docker client, forcing
+// it to be fetched again in the next generation cycle
+func (g *CaddyfileGenerator) InvalidateNetworks(clientIndex int) {
+	g.networksCache.invalidate(clientIndex)
+}
+
+// HandleNetworkEvent invalidates the cached network metadata of a docker client when
+// the event can change which networks are ingress networks
+func (g *CaddyfileGenerator) HandleNetworkEvent(clientIndex int, event events.Message) {
+	if event.Type != events.NetworkEventType {
+		return
+	}
+	switch event.Action {
+	case events.ActionCreate, events.ActionDestroy:
+		g.InvalidateNetworks(clientIndex)
+	case events.ActionConnect, events.ActionDisconnect:
+		// Only the controller attachments are used to infer ingress networks
+		if len(g.options.IngressNetworks) == 0 {
+			containerID, err := g.dockerUtils.GetCurrentContainerID()
+			if err != nil || event.Actor.Attributes["container"] == containerID {
+				g.InvalidateNetworks(clientIndex)
+			}
+		}
+	}
+}
+
+func (g *CaddyfileGenerator) getIngressNetworks(logger *zap.Logger) (map[string]bool, error) {
+	ingressNetworks := map[string]bool{}
+	var firstErr error
+
+	for i, dockerClient := range g.dockerClients {
+		entry, refresh := g.networksCache.get(i)
+		if refresh {
+			clientIngressNetworks, err := g.fetchIngressNetworks(dockerClient, logger)
+			if err == nil {
+				g.networksCache.set(i, clientIngressNetworks)
+				entry, _ = g.networksCache.get(i)
+			} else {
+				if firstErr == nil {
+					firstErr = err
+				}
+				if entry != nil {
+					logger.Warn("Using previous ingress networks", zap.Error(err))
+				}
+			}
+		}
+		if entry != nil {
+			for network := range entry.ingressNetworks {
+				ingressNetworks[network] = true
+			}
+		}
+	}
+
+	logger.Debug("IngressNetworksMap", zap.String("ingress", fmt.Sprintf("%v", ingressNetworks)))
+
+	return ingressNetworks, firstErr
+}
+
+func (g *CaddyfileGenerator) fetchIngressNetworks(dockerClient docker.Client, logger *zap.Logger) (map[string]bool, error) {
+	ingressNetworks := map[string]bool{}
+
+	if len(g.options.IngressNetworks) > 0 {
+		g.countAPICall("NetworkList")
+		networks, err := dockerClient.NetworkList(context.Background(), client.NetworkListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, dockerNetwork := range networks {
+			if dockerNetwork.Ingress {
+				continue
+			}
+			if g.isLabeledIngressNetwork(dockerNetwork.Labels) {
+				ingressNetworks[dockerNetwork.ID] = true
+				ingressNetworks[dockerNetwork.Name] = true
+			}
+			for _, ingressNetwork := range g.options.IngressNetworks {
+				if dockerNetwork.Name == ingressNetwork {
+					ingressNetworks[dockerNetwork.ID] = true
+					ingressNetworks[dockerNetwork.Name] = true
+				}
+			}
+		}
+	} else {
+		containerID, err := g.dockerUtils.GetCurrentContainerID()
+		if err != nil {
+			return nil, err
+		}
+		logger.Debug("Caddy ContainerID", zap.String("ID", containerID))
+		g.countAPICall("ContainerInspect")
+		container, err := dockerClient.ContainerInspect(context.Background(), containerID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, networkEndpoint := range container.NetworkSettings.Networks {
+			g.countAPICall("NetworkInspect")
+			networkInfo, err := dockerClient.NetworkInspect(context.Background(), networkEndpoint.NetworkID, client.NetworkInspectOptions{})
+			if err != nil {
+				return nil, err
+			}
+			g.networkNames[networkInfo.ID] = networkInfo.Name
+			if networkInfo.Ingress {
+				continue
+			}
+			ingressNetworks[networkInfo.ID] = true
+			ingressNetworks[networkInfo.Name] = true
+		}
+
+		if g.options.IngressNetworksLabel != "" {
+			networkListFilter := make(client.Filters)
+			networkListFilter.Add("label", g.options.IngressNetworksLabel)
+
+			g.countAPICall("NetworkList")
+			networks, err := dockerClient.NetworkList(context.Background(), client.NetworkListOptions{Filters: networkListFilter})
+			if err != nil {
+				return nil, err
+			}
+			for _, dockerNetwork := range networks {
+				if !dockerNetwork.Ingress && g.isLabeledIngressNetwork(dockerNetwork.Labels) {
+					ingressNetworks[dockerNetwork.ID] = true
+					ingressNetworks[dockerNetwork.Name] = true
+				}
+			}
+		}
+	}
+
+	return ingressNetworks, nil
+}
+
+// isLabeledIngressNetwork returns if network labels mark it as an ingress network
+func (g *CaddyfileGenerator) isLabeledIngressNetwork(labels map[string]string) bool {
+	if g.options.IngressNetworksLabel == "" {
+		return false
+	}
+	value, hasLabel := labels[g.options.IngressNetworksLabel]
+	return hasLabel && isTrue.MatchString(value)
+}
+
+// parseIngressNetworkLabel returns the networks, by name or ID, listed in the
+// comma separated IngressNetworkLabel, and whether the label is set
+func parseIngressNetworkLabel(labels map[string]string) (map[string]bool, bool) {
+	value, hasLabel := labels[IngressNetworkLabel]
+	if !hasLabel {
+		return nil, false
+	}
+	networks := map[string]bool{}
+	for _, network := range strings.Split(value, ",") {
+		if network = strings.TrimSpace(network); network != "" {
+			networks[network] = true
+		}
+	}
+	return networks, true
+}
+
+// getNetworkName returns the name of a network from its ID. Names are fetched once
+// from docker and kept for the generator lifetime, as network names never change.
+func (g *CaddyfileGenerator) getNetworkName(networkID string, logger *zap.Logger) string {
+	if name, ok := g.networkNames[networkID]; ok {
+		return name
+	}
+	for _, dockerClient := range g.dockerClients {
+		g.countAPICall("NetworkInspect")
+		networkInfo, err := dockerClient.NetworkInspect(context.Background(), networkID, client.NetworkInspectOptions{})
+		if err == nil && networkInfo.Name != "" {
+			g.networkNames[networkID] = networkInfo.Name
+			return networkInfo.Name
+		}
+		if err != nil {
+			logger.Debug("Failed to inspect network", zap.String("network", networkID), zap.Error(err))
+		}
+	}
+	return ""
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
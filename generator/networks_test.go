@@ -0,0 +1,139 @@
+package generator
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/docker"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/events"
+	"github.com/moby/moby/api/types/network"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func createNetworksTestClient() *docker.ClientMock {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		{
+			NetworkSettings: &container.NetworkSettingsSummary{
+				Networks: map[string]*network.EndpointSettings{
+					"caddy-network": {
+						IPAddress: netip.MustParseAddr("172.17.0.2"),
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+			Labels: map[string]string{
+				fmtLabel("%s"):               "service.testdomain.com",
+				fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+			},
+		},
+	}
+	return dockerClient
+}
+
+const networksTestCaddyfile = "service.testdomain.com {\n" +
+	"	reverse_proxy 172.17.0.2\n" +
+	"}\n"
+
+func TestNetworks_CachedBetweenCycles(t *testing.T) {
+	dockerClient := createNetworksTestClient()
+	generator := CreateGenerator([]docker.Client{dockerClient}, createDockerUtilsMock(), &config.Options{LabelPrefix: DefaultLabelPrefix})
+
+	generator.GenerateCaddyfile(zap.NewNop())
+	assert.Equal(t, 1, generator.APICalls()["ContainerInspect"])
+	assert.Equal(t, 1, generator.APICalls()["NetworkInspect"])
+
+	caddyfileBytes, _ := generator.GenerateCaddyfile(zap.NewNop())
+	assert.Equal(t, networksTestCaddyfile, string(caddyfileBytes))
+	assert.Equal(t, 0, generator.APICalls()["ContainerInspect"])
+	assert.Equal(t, 0, generator.APICalls()["NetworkInspect"])
+}
+
+func TestNetworks_InvalidatedByEvents(t *testing.T) {
+	dockerClient := createNetworksTestClient()
+	generator := CreateGenerator([]docker.Client{dockerClient}, createDockerUtilsMock(), &config.Options{LabelPrefix: DefaultLabelPrefix})
+
+	generator.GenerateCaddyfile(zap.NewNop())
+
+	// Other containers connecting to networks don't affect ingress networks
+	generator.HandleNetworkEvent(0, events.Message{
+		Type:   events.NetworkEventType,
+		Action: events.ActionConnect,
+		Actor:  events.Actor{ID: caddyNetworkID, Attributes: map[string]string{"container": "other-container-id"}},
+	})
+	generator.GenerateCaddyfile(zap.NewNop())
+	assert.Equal(t, 0, generator.APICalls()["ContainerInspect"])
+
+	generator.HandleNetworkEvent(0, events.Message{
+		Type:   events.NetworkEventType,
+		Action: events.ActionConnect,
+		Actor:  events.Actor{ID: caddyNetworkID, Attributes: map[string]string{"container": caddyContainerID}},
+	})
+	generator.GenerateCaddyfile(zap.NewNop())
+	assert.Equal(t, 1, generator.APICalls()["ContainerInspect"])
+
+	generator.HandleNetworkEvent(0, events.Message{
+		Type:   events.NetworkEventType,
+		Action: events.ActionDestroy,
+		Actor:  events.Actor{ID: "other-network-id"},
+	})
+	generator.GenerateCaddyfile(zap.NewNop())
+	assert.Equal(t, 1, generator.APICalls()["ContainerInspect"])
+}
+
+func TestNetworks_KeepsPreviousOnError(t *testing.T) {
+	dockerClient := createNetworksTestClient()
+	generator := CreateGenerator([]docker.Client{dockerClient}, createDockerUtilsMock(), &config.Options{LabelPrefix: DefaultLabelPrefix})
+
+	generator.GenerateCaddyfile(zap.NewNop())
+
+	dockerClient.ContainerInspectErr = errors.New("transient error")
+	generator.InvalidateNetworks(0)
+
+	caddyfileBytes, _ := generator.GenerateCaddyfile(zap.NewNop())
+	assert.Equal(t, networksTestCaddyfile, string(caddyfileBytes))
+	assert.Equal(t, 1, generator.APICalls()["ContainerInspect"])
+
+	// The failed refresh is retried in the next cycle
+	dockerClient.ContainerInspectErr = nil
+	generator.GenerateCaddyfile(zap.NewNop())
+	assert.Equal(t, 1, generator.APICalls()["ContainerInspect"])
+}
+
+func TestNetworks_LabeledIngressNetworks(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	labeledNetwork := networkSummary("labeled-network-id", "stack_labeled-network")
+	labeledNetwork.Labels = map[string]string{"caddy_ingress": "true"}
+	disabledNetwork := networkSummary("disabled-network-id", "stack_disabled-network")
+	disabledNetwork.Labels = map[string]string{"caddy_ingress": "false"}
+	dockerClient.NetworksData = []network.Summary{
+		networkSummary("named-network-id", "named-network"),
+		labeledNetwork,
+		disabledNetwork,
+	}
+
+	for _, ingressNetworks := range [][]string{nil, {"named-network"}} {
+		generator := CreateGenerator([]docker.Client{dockerClient}, createDockerUtilsMock(), &config.Options{
+			LabelPrefix:          DefaultLabelPrefix,
+			IngressNetworks:      ingressNetworks,
+			IngressNetworksLabel: "caddy_ingress",
+		})
+
+		networks, err := generator.getIngressNetworks(zap.NewNop())
+		assert.NoError(t, err)
+		assert.True(t, networks["labeled-network-id"])
+		assert.True(t, networks["stack_labeled-network"])
+		assert.False(t, networks["disabled-network-id"])
+		if ingressNetworks == nil {
+			assert.True(t, networks[caddyNetworkID])
+			assert.False(t, networks["named-network-id"])
+		} else {
+			assert.False(t, networks[caddyNetworkID])
+			assert.True(t, networks["named-network-id"])
+		}
+	}
+}
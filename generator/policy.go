@@ -0,0 +1,265 @@
+package generator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/caddyfile"
+	"go.uber.org/zap"
+)
+
+const stackNamespaceLabel = "com.docker.stack.namespace"
+
+// LabelsPolicy restricts what containers and services can configure with labels
+type LabelsPolicy struct {
+	// Rules are evaluated in order, the first rule matching a container or
+	// service applies to it
+	Rules []LabelsPolicyRule `json:"rules"`
+	// Default applies to containers and services matching no rule. They are
+	// not restricted when it isn't set.
+	Default *LabelsPolicyRule `json:"default,omitempty"`
+}
+
+// LabelsPolicyRule restricts the caddyfile generated from the labels of the
+// containers and services it matches
+type LabelsPolicyRule struct {
+	// ComposeProject matches containers of a compose project
+	ComposeProject string `json:"compose_project,omitempty"`
+	// StackNamespace matches services and containers of a Swarm stack
+	StackNamespace string `json:"stack_namespace,omitempty"`
+	// Labels matches containers and services having all these labels, an
+	// empty value matching any value
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Domains allowed in site addresses. A domain starting with *. allows all
+	// its subdomains. Any domain is allowed when empty.
+	Domains []string `json:"domains,omitempty"`
+	// AllowGlobalOptions allows global options blocks
+	AllowGlobalOptions bool `json:"allow_global_options,omitempty"`
+	// AllowSnippets allows snippets and named routes, which sites of other
+	// containers and services can import
+	AllowSnippets bool `json:"allow_snippets,omitempty"`
+	// AllowedDirectives are the only directives allowed in sites when not empty
+	AllowedDirectives []string `json:"allowed_directives,omitempty"`
+	// DeniedDirectives are directives not allowed in sites
+	DeniedDirectives []string `json:"denied_directives,omitempty"`
+}
+
+// routeDirectives contain other directives, which are checked as well
+var routeDirectives = map[string]bool{
+	"handle":        true,
+	"handle_errors": true,
+	"handle_path":   true,
+	"route":         true,
+}
+
+// routeSubdirectives are subdirectives of other directives, like reverse_proxy
+// or intercept, containing directives, which are checked as well
+var routeSubdirectives = map[string]bool{
+	"handle_response": true,
+}
+
+// LoadLabelsPolicy reads a labels policy file
+func LoadLabelsPolicy(path string) (*LabelsPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := &LabelsPolicy{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(policy); err != nil {
+		return nil, fmt.Errorf("invalid labels policy %s: %w", path, err)
+	}
+	return policy, nil
+}
+
+// getLabelsPolicy loads the labels policy on every cycle, so it can be changed
+// without restarting. When it can't be loaded, the last valid policy is kept.
+// It returns false when there is no valid policy to apply.
+func (g *CaddyfileGenerator) getLabelsPolicy(logger *zap.Logger) (*LabelsPolicy, bool) {
+	if g.options.LabelsPolicyPath == "" {
+		return nil, true
+	}
+	policy, err := LoadLabelsPolicy(g.options.LabelsPolicyPath)
+	if err != nil {
+		if g.labelsPolicy == nil {
+			logger.Error("Failed to load labels policy, ignoring all labels", zap.String("path", g.options.LabelsPolicyPath), zap.Error(err))
+			return nil, false
+		}
+		logger.Error("Failed to load labels policy, using previous policy", zap.String("path", g.options.LabelsPolicyPath), zap.Error(err))
+		return g.labelsPolicy, true
+	}
+	g.labelsPolicy = policy
+	return policy, true
+}
+
+// applyLabelsPolicy removes from the caddyfiles generated from labels the blocks
+// and directives not allowed by the policy
+func (g *CaddyfileGenerator) applyLabelsPolicy(sourceCaddyfiles []*sourceCaddyfile, logger *zap.Logger) []*sourceCaddyfile {
+	policy, valid := g.getLabelsPolicy(logger)
+	if policy == nil && valid {
+		return sourceCaddyfiles
+	}
+
+	allowed := make([]*sourceCaddyfile, 0, len(sourceCaddyfiles))
+	for _, sourceCaddyfile := range sourceCaddyfiles {
+		if sourceCaddyfile.owner == "" {
+			allowed = append(allowed, sourceCaddyfile)
+			continue
+		}
+		if !valid {
+			continue
+		}
+		if rule := policy.match(sourceCaddyfile.labels); rule != nil {
+			rule.apply(sourceCaddyfile.caddyfile, sourceCaddyfile.source, logger)
+		}
+		allowed = append(allowed, sourceCaddyfile)
+	}
+	return allowed
+}
+
+func (policy *LabelsPolicy) match(labels map[string]string) *LabelsPolicyRule {
+	for i := range policy.Rules {
+		if policy.Rules[i].matches(labels) {
+			return &policy.Rules[i]
+		}
+	}
+	return policy.Default
+}
+
+func (rule *LabelsPolicyRule) matches(labels map[string]string) bool {
+	if rule.ComposeProject != "" && labels[composeProjectLabel] != rule.ComposeProject {
+		return false
+	}
+	if rule.StackNamespace != "" && labels[stackNamespaceLabel] != rule.StackNamespace {
+		return false
+	}
+	for key, value := range rule.Labels {
+		labelValue, hasLabel := labels[key]
+		if !hasLabel || (value != "" && labelValue != value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *LabelsPolicyRule) apply(container *caddyfile.Container, source string, logger *zap.Logger) {
+	container.Sort()
+	for _, block := range container.Children {
+		var violation string
+		switch {
+		case block.IsGlobalBlock():
+			if !rule.AllowGlobalOptions {
+				violation = "global options are not allowed"
+			}
+		case block.IsSnippet() || block.IsNamedRoute():
+			if !rule.AllowSnippets {
+				violation = "snippets are not allowed"
+			}
+		default:
+			for _, address := range siteAddresses(block) {
+				if !rule.allowsAddress(address) {
+					violation = fmt.Sprintf("domain of %s is not allowed", address)
+					break
+				}
+			}
+		}
+		if violation != "" {
+			container.Remove(block)
+			logger.Warn("Removing block not allowed by labels policy", zap.String("source", source), zap.String("reason", violation), zap.ByteString("block", block.Marshal()))
+			continue
+		}
+		if !block.IsGlobalBlock() && !block.IsSnippet() && !block.IsNamedRoute() {
+			rule.removeDirectives(block.Container, source, logger)
+		}
+	}
+}
+
+// removeDirectives removes directives not allowed by the rule, checking directives
+// nested in route directives and route subdirectives as well
+func (rule *LabelsPolicyRule) removeDirectives(container *caddyfile.Container, source string, logger *zap.Logger) {
+	for _, directive := range container.Children {
+		name := directive.GetFirstKey()
+		if directive.IsMatcher() {
+			continue
+		}
+		if !rule.allowsDirective(name) {
+			container.Remove(directive)
+			logger.Warn("Removing directive not allowed by labels policy", zap.String("source", source), zap.String("directive", name), zap.ByteString("block", directive.Marshal()))
+			continue
+		}
+		if routeDirectives[name] {
+			rule.removeDirectives(directive.Container, source, logger)
+		} else {
+			rule.removeSubdirectives(directive.Container, source, logger)
+		}
+	}
+}
+
+// removeSubdirectives removes directives not allowed by the rule from the route
+// subdirectives found at any depth of a directive
+func (rule *LabelsPolicyRule) removeSubdirectives(container *caddyfile.Container, source string, logger *zap.Logger) {
+	for _, subdirective := range container.Children {
+		if routeSubdirectives[subdirective.GetFirstKey()] {
+			rule.removeDirectives(subdirective.Container, source, logger)
+		} else {
+			rule.removeSubdirectives(subdirective.Container, source, logger)
+		}
+	}
+}
+
+func (rule *LabelsPolicyRule) allowsDirective(name string) bool {
+	for _, denied := range rule.DeniedDirectives {
+		if name == denied {
+			return false
+		}
+	}
+	if len(rule.AllowedDirectives) == 0 {
+		return true
+	}
+	for _, allowed := range rule.AllowedDirectives {
+		if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *LabelsPolicyRule) allowsAddress(address string) bool {
+	if len(rule.Domains) == 0 {
+		return true
+	}
+	host := addressHost(address)
+	if host == "" {
+		return false
+	}
+	for _, domain := range rule.Domains {
+		domain = strings.ToLower(domain)
+		if host == domain {
+			return true
+		}
+		if strings.HasPrefix(domain, "*.") && strings.HasSuffix(host, domain[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressHost returns the host of a site address, without scheme, port or path
+func addressHost(address string) string {
+	if i := strings.Index(address, "://"); i >= 0 {
+		address = address[i+3:]
+	}
+	if i := strings.Index(address, "/"); i >= 0 {
+		address = address[:i]
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
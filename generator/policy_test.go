@@ -0,0 +1,165 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+	"github.com/moby/moby/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeLabelsPolicy(t *testing.T, policy string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(policy), 0600))
+	return path
+}
+
+func TestLabelsPolicy_DomainsAndGlobalOptions(t *testing.T) {
+	policyPath := writeLabelsPolicy(t, `{
+		"rules": [
+			{"compose_project": "team-a", "domains": ["*.team-a.example.com"]}
+		]
+	}`)
+
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		createContainer("team-a-web", "172.17.0.2", map[string]string{
+			"com.docker.compose.project":   "team-a",
+			fmtLabel("%s_0"):               "web.team-a.example.com",
+			fmtLabel("%s_0.reverse_proxy"): "{{upstreams}}",
+			fmtLabel("%s_1"):               "admin.example.com",
+			fmtLabel("%s_1.reverse_proxy"): "{{upstreams}}",
+			fmtLabel("%s_2.admin"):         "0.0.0.0:2019",
+		}),
+		createContainer("other", "172.17.0.3", map[string]string{
+			fmtLabel("%s"):               "other.example.com",
+			fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+		}),
+	}
+
+	const expectedCaddyfile = "other.example.com {\n" +
+		"	reverse_proxy 172.17.0.3\n" +
+		"}\n" +
+		"web.team-a.example.com {\n" +
+		"	reverse_proxy 172.17.0.2\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Removing block not allowed by labels policy	{"source": "container team-a-web", "reason": "global options are not allowed", "block": "{\n\tadmin 0.0.0.0:2019\n}\n"}` + newLine +
+		`WARN	Removing block not allowed by labels policy	{"source": "container team-a-web", "reason": "domain of admin.example.com is not allowed", "block": "admin.example.com {\n\treverse_proxy 172.17.0.2\n}\n"}` + newLine
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.LabelsPolicyPath = policyPath
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestLabelsPolicy_DeniedDirectives(t *testing.T) {
+	policyPath := writeLabelsPolicy(t, `{
+		"rules": [
+			{"labels": {"tenant": ""}, "denied_directives": ["tls", "import"]}
+		]
+	}`)
+
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		createContainer("tenant", "172.17.0.2", map[string]string{
+			"tenant":                            "a",
+			fmtLabel("%s"):                      "tenant.example.com",
+			fmtLabel("%s.tls"):                  "internal",
+			fmtLabel("%s.handle.import"):        "shared",
+			fmtLabel("%s.handle.reverse_proxy"): "{{upstreams}}",
+		}),
+	}
+
+	const expectedCaddyfile = "tenant.example.com {\n" +
+		"	handle {\n" +
+		"		reverse_proxy 172.17.0.2\n" +
+		"	}\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Removing directive not allowed by labels policy	{"source": "container tenant", "directive": "import", "block": "import shared\n"}` + newLine +
+		`WARN	Removing directive not allowed by labels policy	{"source": "container tenant", "directive": "tls", "block": "tls internal\n"}` + newLine
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.LabelsPolicyPath = policyPath
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestLabelsPolicy_InvalidPolicyIgnoresLabels(t *testing.T) {
+	policyPath := writeLabelsPolicy(t, `{"rules": [{"unknown": true}]}`)
+
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		createContainer("web", "172.17.0.2", map[string]string{
+			fmtLabel("%s"):               "web.example.com",
+			fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+		}),
+	}
+
+	const expectedCaddyfile = "# Empty caddyfile"
+
+	const expectedLogs = commonLogs +
+		`ERROR	Failed to load labels policy, ignoring all labels	{"path": "` + "%s" + `", "error": "invalid labels policy ` + "%s" + `: json: unknown field \"unknown\""}` + newLine
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.LabelsPolicyPath = policyPath
+	}, expectedCaddyfile, fmtLogs(expectedLogs, policyPath))
+}
+
+func TestLoadLabelsPolicy(t *testing.T) {
+	policy, err := LoadLabelsPolicy(writeLabelsPolicy(t, `{"rules": [{"stack_namespace": "stack", "allowed_directives": ["reverse_proxy"]}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, &LabelsPolicy{Rules: []LabelsPolicyRule{{StackNamespace: "stack", AllowedDirectives: []string{"reverse_proxy"}}}}, policy)
+}
+
+func fmtLogs(logs string, path string) string {
+	return strings.ReplaceAll(logs, "%s", path)
+}
+
+func TestLabelsPolicy_DefaultRuleAndNestedDirectives(t *testing.T) {
+	policyPath := writeLabelsPolicy(t, `{
+		"rules": [
+			{"compose_project": "trusted"}
+		],
+		"default": {"denied_directives": ["respond"]}
+	}`)
+
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		createContainer("web", "172.17.0.2", map[string]string{
+			fmtLabel("%s"):               "web.example.com",
+			fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+			fmtLabel("%s.reverse_proxy.handle_response.respond"): "denied",
+			fmtLabel("%s.reverse_proxy.handle_response.redir"):   "https://example.com",
+		}),
+		createContainer("trusted", "172.17.0.3", map[string]string{
+			"com.docker.compose.project": "trusted",
+			fmtLabel("%s"):               "trusted.example.com",
+			fmtLabel("%s.respond"):       "ok",
+		}),
+	}
+
+	const expectedCaddyfile = "trusted.example.com {\n" +
+		"	respond ok\n" +
+		"}\n" +
+		"web.example.com {\n" +
+		"	reverse_proxy 172.17.0.2 {\n" +
+		"		handle_response {\n" +
+		"			redir https://example.com\n" +
+		"		}\n" +
+		"	}\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Removing directive not allowed by labels policy	{"source": "container web", "directive": "respond", "block": "respond denied\n"}` + newLine
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.LabelsPolicyPath = policyPath
+	}, expectedCaddyfile, expectedLogs)
+}
@@ -0,0 +1,300 @@
+package generator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/caddyfile"
+	"go.uber.org/zap"
+)
+
+// RuleAction is what a rule does to the sites matching its condition
+type RuleAction string
+
+const (
+	// RuleWarn logs a warning
+	RuleWarn RuleAction = "warn"
+	// RuleMutate adds or removes directives
+	RuleMutate RuleAction = "mutate"
+	// RuleReject removes the site
+	RuleReject RuleAction = "reject"
+)
+
+// Rules are evaluated on every site of the generated caddyfile, after merging
+// all sources and before processing it
+type Rules struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule applies an action to the sites matching a CEL condition
+type Rule struct {
+	Name string `json:"name"`
+	// Condition is a CEL expression over the site variable, with the fields
+	// addresses, sources and directives. Each directive has a name, args and
+	// nested directives.
+	Condition string     `json:"condition"`
+	Action    RuleAction `json:"action"`
+	// Message is logged when the rule applies
+	Message string `json:"message,omitempty"`
+	// Add contains directives, in caddyfile format, added to sites by mutate rules
+	Add string `json:"add,omitempty"`
+	// Remove contains directive names removed from sites by mutate rules
+	Remove []string `json:"remove,omitempty"`
+
+	program cel.Program
+	add     *caddyfile.Container
+}
+
+// loadedRules are the compiled rules of a rules file
+type loadedRules struct {
+	content []byte
+	rules   []Rule
+}
+
+// LoadRules reads and compiles a rules file
+func LoadRules(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRules(data)
+}
+
+func parseRules(data []byte) (*Rules, error) {
+	rules := &Rules{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(rules); err != nil {
+		return nil, err
+	}
+
+	env, err := rulesEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %s is defined more than once", rule.Name)
+		}
+		names[rule.Name] = true
+
+		switch rule.Action {
+		case RuleWarn, RuleReject:
+		case RuleMutate:
+			if rule.Add == "" && len(rule.Remove) == 0 {
+				return nil, fmt.Errorf("rule %s mutates nothing, set add or remove", rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rule %s has invalid action %q, expected warn, mutate or reject", rule.Name, rule.Action)
+		}
+
+		ast, issues := env.Compile(rule.Condition)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Name, issues.Err())
+		}
+		if ast.OutputType() != cel.BoolType {
+			return nil, fmt.Errorf("rule %s condition must return a bool, not %s", rule.Name, ast.OutputType())
+		}
+		rule.program, err = env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+
+		if rule.Add != "" {
+			rule.add, err = caddyfile.Unmarshal([]byte(rule.Add))
+			if err != nil {
+				return nil, fmt.Errorf("rule %s add: %w", rule.Name, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func rulesEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("site", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Function("upstream_host",
+			cel.Overload("upstream_host_string", []*cel.Type{cel.StringType}, cel.StringType,
+				cel.UnaryBinding(func(value ref.Val) ref.Val {
+					return types.String(upstreamHost(string(value.(types.String))))
+				}),
+			),
+		),
+		cel.Function("cidr_contains",
+			cel.Overload("cidr_contains_string_string", []*cel.Type{cel.StringType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(func(cidr ref.Val, ip ref.Val) ref.Val {
+					prefix, err := netip.ParsePrefix(string(cidr.(types.String)))
+					if err != nil {
+						return types.NewErr("invalid cidr: %s", err)
+					}
+					addr, err := netip.ParseAddr(string(ip.(types.String)))
+					if err != nil {
+						return types.False
+					}
+					return types.Bool(prefix.Contains(addr.Unmap()))
+				}),
+			),
+		),
+	)
+}
+
+// upstreamHost returns the host of an upstream address, without scheme or port
+func upstreamHost(upstream string) string {
+	if i := strings.Index(upstream, "://"); i >= 0 {
+		upstream = upstream[i+3:]
+	}
+	if host, _, err := net.SplitHostPort(upstream); err == nil {
+		return host
+	}
+	return strings.Trim(upstream, "[]")
+}
+
+// getRules loads the rules file on every cycle, compiling it only when it
+// changed. When it can't be loaded, the last valid rules are kept.
+func (g *CaddyfileGenerator) getRules(logger *zap.Logger) []Rule {
+	if g.options.RulesPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(g.options.RulesPath)
+	if err == nil && g.rules != nil && bytes.Equal(data, g.rules.content) {
+		return g.rules.rules
+	}
+	var rules *Rules
+	if err == nil {
+		rules, err = parseRules(data)
+	}
+	if err != nil {
+		logger.Error("Failed to load rules, using previous rules", zap.String("path", g.options.RulesPath), zap.Error(err))
+		if g.rules == nil {
+			return nil
+		}
+		return g.rules.rules
+	}
+	g.rules = &loadedRules{content: data, rules: rules.Rules}
+	return rules.Rules
+}
+
+// applyRules evaluates rules on every site of the caddyfile
+func (g *CaddyfileGenerator) applyRules(caddyfileBlock *caddyfile.Container, logger *zap.Logger) {
+	rules := g.getRules(logger)
+	if len(rules) == 0 {
+		return
+	}
+
+	caddyfileBlock.Sort()
+	for _, site := range caddyfileBlock.Children {
+		if site.IsGlobalBlock() || site.IsSnippet() || site.IsNamedRoute() || site.IsMatcher() {
+			continue
+		}
+	RulesLoop:
+		for i := range rules {
+			rule := &rules[i]
+			result, _, err := rule.program.Eval(map[string]interface{}{"site": siteValue(site)})
+			if err != nil {
+				logger.Error("Failed to evaluate rule", zap.String("rule", rule.Name), zap.Strings("addresses", site.Keys), zap.Error(err))
+				// Reject rules fail closed, rejecting the sites they can't evaluate
+				if rule.Action != RuleReject {
+					continue
+				}
+			} else if result != types.True {
+				continue
+			}
+
+			g.ruleHits[rule.Name]++
+			fields := []zap.Field{
+				zap.String("rule", rule.Name),
+				zap.Strings("addresses", site.Keys),
+				zap.Strings("sources", site.Sources),
+			}
+			if rule.Message != "" {
+				fields = append(fields, zap.String("message", rule.Message))
+			}
+
+			switch rule.Action {
+			case RuleWarn:
+				logger.Warn("Site matches rule", fields...)
+			case RuleReject:
+				logger.Warn("Removing site rejected by rule", fields...)
+				caddyfileBlock.Remove(site)
+				break RulesLoop
+			case RuleMutate:
+				logger.Info("Mutating site by rule", fields...)
+				for _, directive := range site.Children {
+					if slices.Contains(rule.Remove, directive.GetFirstKey()) {
+						site.Remove(directive)
+					}
+				}
+				if rule.add != nil {
+					logMergeConflicts(site.Merge(copyContainer(rule.add, "rule "+rule.Name)), logger)
+				}
+			}
+		}
+	}
+}
+
+// RuleHits returns how many times each rule applied since the generator was created
+func (g *CaddyfileGenerator) RuleHits() map[string]int64 {
+	hits := make(map[string]int64, len(g.ruleHits))
+	for name, count := range g.ruleHits {
+		hits[name] = count
+	}
+	return hits
+}
+
+// siteValue converts a site into the CEL site variable
+func siteValue(site *caddyfile.Block) map[string]interface{} {
+	sources := site.Sources
+	if sources == nil {
+		sources = []string{}
+	}
+	return map[string]interface{}{
+		"addresses":  siteAddresses(site),
+		"sources":    sources,
+		"directives": directivesValue(site.Container),
+	}
+}
+
+func directivesValue(container *caddyfile.Container) []interface{} {
+	directives := make([]interface{}, 0, len(container.Children))
+	for _, block := range container.Children {
+		args := []string{}
+		if len(block.Keys) > 1 {
+			args = block.Keys[1:]
+		}
+		directives = append(directives, map[string]interface{}{
+			"name":       block.GetFirstKey(),
+			"args":       args,
+			"directives": directivesValue(block.Container),
+		})
+	}
+	return directives
+}
+
+// copyContainer deep copies a container, so it can be merged in many sites
+func copyContainer(container *caddyfile.Container, source string) *caddyfile.Container {
+	copied := caddyfile.CreateContainer()
+	for _, block := range container.Children {
+		copiedBlock := caddyfile.CreateBlock()
+		copiedBlock.Order = block.Order
+		copiedBlock.AddKeys(block.Keys...)
+		copiedBlock.AddSources(source)
+		copiedBlock.Container = copyContainer(block.Container, source)
+		copied.AddBlock(copiedBlock)
+	}
+	return copied
+}
@@ -0,0 +1,201 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/docker"
+	"github.com/moby/moby/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeRules(t *testing.T, rules string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0600))
+	return path
+}
+
+func rulesDockerClient() *docker.ClientMock {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		createContainer("web", "10.0.0.2", map[string]string{
+			fmtLabel("%s"):               "web.example.com",
+			fmtLabel("%s.reverse_proxy"): "{{upstreams 8080}}",
+			fmtLabel("%s.encode"):        "gzip",
+		}),
+		createContainer("api", "172.17.0.3", map[string]string{
+			fmtLabel("%s"):               "api.example.com",
+			fmtLabel("%s.reverse_proxy"): "{{upstreams 8080}}",
+		}),
+	}
+	return dockerClient
+}
+
+func TestRules_Warn(t *testing.T) {
+	rulesPath := writeRules(t, `{
+		"rules": [
+			{
+				"name": "encode",
+				"condition": "!site.directives.exists(d, d.name == 'encode')",
+				"action": "warn",
+				"message": "every site must have encode"
+			}
+		]
+	}`)
+
+	const expectedCaddyfile = "api.example.com {\n" +
+		"	reverse_proxy 172.17.0.3:8080\n" +
+		"}\n" +
+		"web.example.com {\n" +
+		"	encode gzip\n" +
+		"	reverse_proxy 10.0.0.2:8080\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Site matches rule	{"rule": "encode", "addresses": ["api.example.com"], "sources": ["container api"], "message": "every site must have encode"}` + newLine
+
+	testGeneration(t, rulesDockerClient(), func(options *config.Options) {
+		options.RulesPath = rulesPath
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestRules_Mutate(t *testing.T) {
+	rulesPath := writeRules(t, `{
+		"rules": [
+			{
+				"name": "hide-server",
+				"condition": "site.addresses.exists(a, a.endsWith('.example.com'))",
+				"action": "mutate",
+				"add": "header -Server",
+				"remove": ["encode"]
+			}
+		]
+	}`)
+
+	const expectedCaddyfile = "api.example.com {\n" +
+		"	header -Server\n" +
+		"	reverse_proxy 172.17.0.3:8080\n" +
+		"}\n" +
+		"web.example.com {\n" +
+		"	header -Server\n" +
+		"	reverse_proxy 10.0.0.2:8080\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`INFO	Mutating site by rule	{"rule": "hide-server", "addresses": ["api.example.com"], "sources": ["container api"]}` + newLine +
+		`INFO	Mutating site by rule	{"rule": "hide-server", "addresses": ["web.example.com"], "sources": ["container web"]}` + newLine
+
+	testGeneration(t, rulesDockerClient(), func(options *config.Options) {
+		options.RulesPath = rulesPath
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestRules_Reject(t *testing.T) {
+	rulesPath := writeRules(t, `{
+		"rules": [
+			{
+				"name": "private-upstreams",
+				"condition": "site.directives.exists(d, d.name == 'reverse_proxy' && d.args.exists(a, !cidr_contains('10.0.0.0/8', upstream_host(a))))",
+				"action": "reject",
+				"message": "upstreams must be in 10.0.0.0/8"
+			}
+		]
+	}`)
+
+	const expectedCaddyfile = "web.example.com {\n" +
+		"	encode gzip\n" +
+		"	reverse_proxy 10.0.0.2:8080\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Removing site rejected by rule	{"rule": "private-upstreams", "addresses": ["api.example.com"], "sources": ["container api"], "message": "upstreams must be in 10.0.0.0/8"}` + newLine
+
+	testGeneration(t, rulesDockerClient(), func(options *config.Options) {
+		options.RulesPath = rulesPath
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestRules_RejectFailsClosed(t *testing.T) {
+	rulesPath := writeRules(t, `{
+		"rules": [
+			{
+				"name": "numeric-address",
+				"condition": "!site.directives.exists(d, d.name == 'encode') && int(site.addresses[0]) > 0",
+				"action": "reject"
+			}
+		]
+	}`)
+
+	const expectedCaddyfile = "web.example.com {\n" +
+		"	encode gzip\n" +
+		"	reverse_proxy 10.0.0.2:8080\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`ERROR	Failed to evaluate rule	{"rule": "numeric-address", "addresses": ["api.example.com"], "error": "type conversion error from 'string' to 'int'"}` + newLine +
+		`WARN	Removing site rejected by rule	{"rule": "numeric-address", "addresses": ["api.example.com"], "sources": ["container api"]}` + newLine
+
+	testGeneration(t, rulesDockerClient(), func(options *config.Options) {
+		options.RulesPath = rulesPath
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestRules_Hits(t *testing.T) {
+	rulesPath := writeRules(t, `{
+		"rules": [
+			{"name": "all", "condition": "true", "action": "warn"},
+			{"name": "none", "condition": "false", "action": "warn"}
+		]
+	}`)
+
+	options := &config.Options{
+		LabelPrefix: DefaultLabelPrefix,
+		RulesPath:   rulesPath,
+	}
+	generator := CreateGenerator([]docker.Client{rulesDockerClient()}, createDockerUtilsMock(), options)
+
+	logger := zap.NewNop()
+	generator.GenerateCaddyfile(logger)
+	generator.GenerateCaddyfile(logger)
+
+	assert.Equal(t, map[string]int64{"all": 4}, generator.RuleHits())
+}
+
+func TestRules_InvalidRules(t *testing.T) {
+	_, err := parseRules([]byte(`{"rules": [{"name": "a", "condition": "site.addresses", "action": "warn"}]}`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rule a condition must return a bool")
+
+	_, err = parseRules([]byte(`{"rules": [{"name": "a", "condition": "true", "action": "delete"}]}`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `rule a has invalid action "delete"`)
+
+	_, err = parseRules([]byte(`{"rules": [{"name": "a", "condition": "true", "action": "mutate"}]}`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rule a mutates nothing")
+
+	_, err = parseRules([]byte(`{"rules": [{"name": "a", "condition": "site.", "action": "warn"}]}`))
+	require.Error(t, err)
+}
+
+func TestRules_InvalidFileKeepsPreviousRules(t *testing.T) {
+	rulesPath := writeRules(t, `{"rules": [{"name": "all", "condition": "true", "action": "reject"}]}`)
+	options := &config.Options{
+		LabelPrefix: DefaultLabelPrefix,
+		RulesPath:   rulesPath,
+	}
+	generator := CreateGenerator([]docker.Client{rulesDockerClient()}, createDockerUtilsMock(), options)
+
+	logger := zap.NewNop()
+	caddyfile, _ := generator.GenerateCaddyfile(logger)
+	assert.Equal(t, "# Empty caddyfile", string(caddyfile))
+
+	options.RulesPath = writeRules(t, `{"rules": [`)
+	caddyfile, _ = generator.GenerateCaddyfile(logger)
+	assert.Equal(t, "# Empty caddyfile", string(caddyfile))
+}
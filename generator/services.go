@@ -2,20 +2,87 @@ package generator
 
 import (
 	"context"
+	"net"
+	"net/netip"
+	"strconv"
 
 	"github.com/lucaslorentz/caddy-docker-proxy/v2/caddyfile"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+	"github.com/moby/moby/api/types/network"
 	"github.com/moby/moby/api/types/swarm"
 	"github.com/moby/moby/client"
 
 	"go.uber.org/zap"
 )
 
-func (g *CaddyfileGenerator) getServiceCaddyfile(service *swarm.Service, logger *zap.Logger) (*caddyfile.Container, error) {
+func (g *CaddyfileGenerator) getServiceCaddyfile(clientIndex int, service *swarm.Service, logger *zap.Logger) (*caddyfile.Container, error) {
 	caddyLabels := g.filterLabels(service.Spec.Labels)
 
-	return labelsToCaddyfile(caddyLabels, service, func() ([]string, error) {
-		return g.getServiceProxyTargets(service, logger, true)
-	})
+	getTargets := func(options upstreamsOptions) ([]string, error) {
+		mode := g.getUpstreamsMode(service.Spec.Labels, logger)
+		if options.dynamic {
+			targets, err := g.getServiceProxyTargets(service, logger, true)
+			g.addDynamicUpstreams(serviceSelector(service), targets)
+			return dynamicUpstreamsArgs(serviceSelector(service), options.port), err
+		}
+		if options.hostname || mode == config.UpstreamsHostname {
+			return g.getServiceHostnames(service, options.hostnameKind, options.port, logger)
+		}
+		if mode == config.UpstreamsPublished {
+			return g.getServicePublishedAddresses(clientIndex, service, options.port, logger)
+		}
+		targets, err := g.getServiceProxyTargets(service, logger, true)
+		return withPort(targets, options.port), err
+	}
+
+	caddyfileBlock, err := labelsToCaddyfile(caddyLabels, service, getTargets)
+	if err == nil && g.options.TraefikLabels {
+		err = g.addTraefikCaddyfile(caddyfileBlock, service.Spec.Labels, serviceSource(service), getTargets, logger)
+	}
+	if caddyfileBlock != nil {
+		caddyfileBlock.SetSource(serviceSource(service))
+	}
+	return caddyfileBlock, withLabelSource(err, serviceSource(service))
+}
+
+// serviceSource describes a service as the source of caddyfile blocks
+func serviceSource(service *swarm.Service) string {
+	return "service " + service.Spec.Name
+}
+
+// getServiceHostnames returns the DNS name of a service of the requested kind. By
+// default, tasks.<service> is used when proxying service tasks, so Caddy resolves
+// all task IPs, otherwise the service name resolving to its virtual IP.
+func (g *CaddyfileGenerator) getServiceHostnames(service *swarm.Service, kind string, port int, logger *zap.Logger) ([]string, error) {
+	// Only used to warn about services caddy can't reach
+	_, err := g.getServiceProxyTargets(service, logger, true)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname := service.Spec.Name
+	switch kind {
+	case hostnameTasks:
+		hostname = "tasks." + service.Spec.Name
+	case hostnameAlias:
+		networksFromLabel, overrideNetwork := parseIngressNetworkLabel(service.Spec.Labels)
+		for _, attachment := range service.Spec.TaskTemplate.Networks {
+			inIngressNetwork := g.ingressNetworks[attachment.Target]
+			if overrideNetwork {
+				inIngressNetwork = networksFromLabel[attachment.Target] || networksFromLabel[g.getNetworkName(attachment.Target, logger)]
+			}
+			if inIngressNetwork && len(attachment.Aliases) > 0 {
+				hostname = attachment.Aliases[0]
+				break
+			}
+		}
+	case "":
+		if g.options.ProxyServiceTasks {
+			hostname = "tasks." + service.Spec.Name
+		}
+	}
+
+	return withPort([]string{hostname}, port), nil
 }
 
 func (g *CaddyfileGenerator) getServiceProxyTargets(service *swarm.Service, logger *zap.Logger, onlyIngressIps bool) ([]string, error) {
@@ -34,29 +101,39 @@ func (g *CaddyfileGenerator) getServiceProxyTargets(service *swarm.Service, logg
 func (g *CaddyfileGenerator) getServiceVirtualIps(service *swarm.Service, logger *zap.Logger, onlyIngressIps bool) ([]string, error) {
 	virtualIps := []string{}
 
+	networksFromLabel, overrideNetwork := parseIngressNetworkLabel(service.Spec.Labels)
+
 	for _, virtualIP := range service.Endpoint.VirtualIPs {
-		if !onlyIngressIps || g.ingressNetworks[virtualIP.NetworkID] {
+		include := false
+
+		if !onlyIngressIps {
+			include = true
+		} else if overrideNetwork {
+			include = networksFromLabel[virtualIP.NetworkID] || networksFromLabel[g.getNetworkName(virtualIP.NetworkID, logger)]
+		} else {
+			include = g.ingressNetworks[virtualIP.NetworkID]
+		}
+
+		if include {
 			virtualIps = append(virtualIps, virtualIP.Addr.String())
 		}
 	}
 
 	if len(virtualIps) == 0 {
-		logger.Warn("Service is not in same network as caddy", zap.String("service", service.Spec.Name), zap.String("serviceId", service.ID))
+		g.warnServiceNotInIngressNetwork(service, logger, networksFromLabel, overrideNetwork)
 	}
 
 	return virtualIps, nil
 }
 
 func (g *CaddyfileGenerator) getServiceTasksIps(service *swarm.Service, logger *zap.Logger, onlyIngressIps bool) ([]string, error) {
-	taskListFilter := make(client.Filters)
-	taskListFilter.Add("service", service.ID)
-	taskListFilter.Add("desired-state", "running")
-
 	hasRunningTasks := false
 	tasksIps := []string{}
 
-	for _, dockerClient := range g.dockerClients {
-		tasks, err := dockerClient.TaskList(context.Background(), client.TaskListOptions{Filters: taskListFilter})
+	networksFromLabel, overrideNetwork := parseIngressNetworkLabel(service.Spec.Labels)
+
+	for i := range g.dockerClients {
+		tasks, err := g.getServiceTasks(i, service.ID)
 		if err != nil {
 			logger.Debug("Failed to get Swarm tasks from docker client, skipping", zap.String("service", service.Spec.Name), zap.Error(err))
 			continue
@@ -65,7 +142,6 @@ func (g *CaddyfileGenerator) getServiceTasksIps(service *swarm.Service, logger *
 		for _, task := range tasks {
 			if task.Status.State == swarm.TaskStateRunning {
 				hasRunningTasks = true
-				ingressNetworkFromLabel, overrideNetwork := service.Spec.Labels[IngressNetworkLabel]
 
 				for _, networkAttachment := range task.NetworksAttachments {
 					include := false
@@ -73,15 +149,17 @@ func (g *CaddyfileGenerator) getServiceTasksIps(service *swarm.Service, logger *
 					if !onlyIngressIps {
 						include = true
 					} else if overrideNetwork {
-						include = networkAttachment.Network.Spec.Name == ingressNetworkFromLabel
+						include = networksFromLabel[networkAttachment.Network.Spec.Name] || networksFromLabel[networkAttachment.Network.ID]
 					} else {
 						include = g.ingressNetworks[networkAttachment.Network.ID]
 					}
 
 					if include {
+						addresses := make([]netip.Addr, 0, len(networkAttachment.Addresses))
 						for _, address := range networkAttachment.Addresses {
-							tasksIps = append(tasksIps, address.Addr().String())
+							addresses = append(addresses, address.Addr())
 						}
+						tasksIps = append(tasksIps, addressesToStrings(g.selectAddresses(addresses...))...)
 					}
 				}
 			}
@@ -92,8 +170,82 @@ func (g *CaddyfileGenerator) getServiceTasksIps(service *swarm.Service, logger *
 		logger.Debug("Service has no tasks in running state", zap.String("service", service.Spec.Name), zap.String("serviceId", service.ID))
 
 	} else if len(tasksIps) == 0 {
-		logger.Warn("Service is not in same network as caddy", zap.String("service", service.Spec.Name), zap.String("serviceId", service.ID))
+		g.warnServiceNotInIngressNetwork(service, logger, networksFromLabel, overrideNetwork)
 	}
 
 	return tasksIps, nil
 }
+
+func (g *CaddyfileGenerator) warnServiceNotInIngressNetwork(service *swarm.Service, logger *zap.Logger, networksFromLabel map[string]bool, overrideNetwork bool) {
+	if overrideNetwork {
+		logger.Warn("Service is not in any network listed in "+IngressNetworkLabel,
+			zap.String("service", service.Spec.Name),
+			zap.String("serviceId", service.ID),
+			zap.Strings("label networks", sortedKeys(networksFromLabel)),
+		)
+	} else {
+		logger.Warn("Service is not in same network as caddy", zap.String("service", service.Spec.Name), zap.String("serviceId", service.ID))
+	}
+}
+
+// getServicePublishedAddresses returns the docker host address with the ports the
+// service publishes through the routing mesh or in host mode. When port isn't zero,
+// only the port published for that target port is used.
+func (g *CaddyfileGenerator) getServicePublishedAddresses(clientIndex int, service *swarm.Service, port int, logger *zap.Logger) ([]string, error) {
+	hostAddress := g.getDockerHostAddress(clientIndex)
+	if hostAddress == "" {
+		logger.Warn("Docker host address is unknown, configure it to proxy published ports",
+			zap.String("service", service.Spec.Name),
+			zap.String("DockerSocket", g.getDockerSocket(clientIndex)),
+		)
+		return []string{}, nil
+	}
+
+	addresses := []string{}
+	for _, portConfig := range service.Endpoint.Ports {
+		if portConfig.PublishedPort == 0 || (portConfig.Protocol != "" && portConfig.Protocol != network.TCP) {
+			continue
+		}
+		if port != 0 && int(portConfig.TargetPort) != port {
+			continue
+		}
+		addresses = append(addresses, net.JoinHostPort(hostAddress, strconv.Itoa(int(portConfig.PublishedPort))))
+	}
+
+	if len(addresses) == 0 {
+		logger.Warn("Service has no published port to proxy", zap.String("service", service.Spec.Name), zap.Int("port", port))
+	}
+
+	return addresses, nil
+}
+
+// serviceTasksIndex holds the tasks listed from a docker client during one
+// generation cycle, indexed by service ID
+type serviceTasksIndex struct {
+	tasksByService map[string][]swarm.Task
+	err            error
+}
+
+// getServiceTasks returns the tasks desired to be running for a service, as known
+// by the docker client at clientIndex. Tasks are listed with a single TaskList call
+// per client per generation cycle, and a failed call is not retried within the cycle.
+func (g *CaddyfileGenerator) getServiceTasks(clientIndex int, serviceID string) ([]swarm.Task, error) {
+	index := g.serviceTasks[clientIndex]
+	if index == nil {
+		taskListFilter := make(client.Filters)
+		taskListFilter.Add("desired-state", "running")
+
+		g.countAPICall("TaskList")
+		tasks, err := g.dockerClients[clientIndex].TaskList(context.Background(), client.TaskListOptions{Filters: taskListFilter})
+
+		index = &serviceTasksIndex{
+			tasksByService: map[string][]swarm.Task{},
+			err:            err,
+		}
+		for _, task := range tasks {
+			index.tasksByService[task.ServiceID] = append(index.tasksByService[task.ServiceID], task)
+		}
+		g.serviceTasks[clientIndex] = index
+	}
+	return index.tasksByService[serviceID], index.err
+}
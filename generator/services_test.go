@@ -143,6 +143,65 @@ func TestServices_ManualIngressNetwork(t *testing.T) {
 	}, expectedCaddyfile, expectedLogs)
 }
 
+func TestServices_OverrideIngressNetwork(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.NetworkInspectData["other-network-id"] = networkInspect("other-network-id", "other-network")
+	dockerClient.ServicesData = []swarm.Service{
+		{
+			ID: "SERVICE-ID",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "service",
+					Labels: map[string]string{
+						"caddy_ingress_network":      "other-network",
+						fmtLabel("%s"):               "service.testdomain.com",
+						fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+					},
+				},
+			},
+			Endpoint: swarm.Endpoint{
+				VirtualIPs: []swarm.EndpointVirtualIP{
+					{
+						NetworkID: caddyNetworkID,
+					},
+				},
+			},
+		},
+		{
+			ID: "OTHER-SERVICE-ID",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "other-service",
+					Labels: map[string]string{
+						"caddy_ingress_network":      "other-network",
+						fmtLabel("%s"):               "other-service.testdomain.com",
+						fmtLabel("%s.reverse_proxy"): "{{upstreams}}",
+					},
+				},
+			},
+			Endpoint: swarm.Endpoint{
+				VirtualIPs: []swarm.EndpointVirtualIP{
+					{
+						NetworkID: "other-network-id",
+					},
+				},
+			},
+		},
+	}
+
+	const expectedCaddyfile = "other-service.testdomain.com {\n" +
+		"	reverse_proxy other-service\n" +
+		"}\n" +
+		"service.testdomain.com {\n" +
+		"	reverse_proxy service\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Service is not in any network listed in caddy_ingress_network	{"service": "service", "serviceId": "SERVICE-ID", "label networks": ["other-network"]}` + newLine
+
+	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
+}
+
 func TestServices_SwarmDisabled(t *testing.T) {
 	dockerClient := createBasicDockerClientMock()
 	dockerClient.ServicesData = []swarm.Service{
@@ -595,3 +654,222 @@ func TestServiceTasks_OneClientTaskListError(t *testing.T) {
 	assert.Equal(t, expectedCaddyfile, string(caddyfileBytes),
 		"manager client's task IP must still reach the Caddyfile when a peer client's TaskList errors")
 }
+
+func TestServiceTasks_SingleTaskListPerCycle(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ServicesData = []swarm.Service{
+		{
+			ID: "SERVICE-A",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "service-a",
+					Labels: map[string]string{
+						fmtLabel("%s"):               "a.testdomain.com",
+						fmtLabel("%s.reverse_proxy"): "{{upstreams 5000}}",
+					},
+				},
+			},
+		},
+		{
+			ID: "SERVICE-B",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "service-b",
+					Labels: map[string]string{
+						fmtLabel("%s"):                   "b.testdomain.com",
+						fmtLabel("%s.reverse_proxy"):     "{{upstreams 5000}}",
+						fmtLabel("%s_controlled_server"): "",
+					},
+				},
+			},
+		},
+	}
+	dockerClient.TasksData = []swarm.Task{
+		{
+			ServiceID: "SERVICE-A",
+			NetworksAttachments: []swarm.NetworkAttachment{
+				{
+					Network:   swarm.Network{ID: caddyNetworkID},
+					Addresses: prefixes("10.0.0.1/24"),
+				},
+			},
+			DesiredState: swarm.TaskStateRunning,
+			Status:       swarm.TaskStatus{State: swarm.TaskStateRunning},
+		},
+		{
+			ServiceID: "SERVICE-B",
+			NetworksAttachments: []swarm.NetworkAttachment{
+				{
+					Network:   swarm.Network{ID: caddyNetworkID},
+					Addresses: prefixes("10.0.0.2/24"),
+				},
+			},
+			DesiredState: swarm.TaskStateRunning,
+			Status:       swarm.TaskStatus{State: swarm.TaskStateRunning},
+		},
+	}
+
+	options := &config.Options{
+		LabelPrefix:            DefaultLabelPrefix,
+		ControlledServersLabel: fmtLabel("%s_controlled_server"),
+		ProxyServiceTasks:      true,
+	}
+
+	generator := CreateGenerator([]docker.Client{dockerClient}, createDockerUtilsMock(), options)
+
+	caddyfileBytes, controlledServers := generator.GenerateCaddyfile(zap.NewNop())
+
+	const expectedCaddyfile = "a.testdomain.com {\n" +
+		"	reverse_proxy 10.0.0.1:5000\n" +
+		"}\n" +
+		"b.testdomain.com {\n" +
+		"	reverse_proxy 10.0.0.2:5000\n" +
+		"}\n"
+
+	assert.Equal(t, expectedCaddyfile, string(caddyfileBytes))
+	assert.Equal(t, []string{"10.0.0.2"}, controlledServers)
+	assert.Equal(t, 1, generator.APICalls()["TaskList"])
+
+	// A new cycle lists tasks again
+	generator.GenerateCaddyfile(zap.NewNop())
+	assert.Equal(t, 1, generator.APICalls()["TaskList"])
+}
+
+func TestServiceTasks_PreferIPv6(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ServicesData = []swarm.Service{
+		{
+			ID: "SERVICEID",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "service",
+					Labels: map[string]string{
+						fmtLabel("%s"):               "service.testdomain.com",
+						fmtLabel("%s.reverse_proxy"): "{{upstreams 5000}}",
+					},
+				},
+			},
+		},
+	}
+	dockerClient.TasksData = []swarm.Task{
+		{
+			ServiceID: "SERVICEID",
+			NetworksAttachments: []swarm.NetworkAttachment{
+				{
+					Network:   swarm.Network{ID: caddyNetworkID},
+					Addresses: prefixes("10.0.0.1/24", "fd00::1/64"),
+				},
+			},
+			DesiredState: swarm.TaskStateRunning,
+			Status:       swarm.TaskStatus{State: swarm.TaskStateRunning},
+		},
+		{
+			ServiceID: "SERVICEID",
+			NetworksAttachments: []swarm.NetworkAttachment{
+				{
+					Network:   swarm.Network{ID: caddyNetworkID},
+					Addresses: prefixes("10.0.0.2/24"),
+				},
+			},
+			DesiredState: swarm.TaskStateRunning,
+			Status:       swarm.TaskStatus{State: swarm.TaskStateRunning},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"	reverse_proxy 10.0.0.2:5000 [fd00::1]:5000\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.ProxyServiceTasks = true
+		options.UpstreamsIPFamily = config.IPPreferV6
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestServices_HostnameUpstreams(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ServicesData = []swarm.Service{
+		{
+			ID: "SERVICEID",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "service",
+					Labels: map[string]string{
+						fmtLabel("%s"):                 "service.testdomain.com",
+						fmtLabel("%s.0_reverse_proxy"): "{{upstreams hostname 5000}}",
+						fmtLabel("%s.1_reverse_proxy"): "/vip* {{upstreams (hostname \"service\") 5000}}",
+					},
+				},
+			},
+		},
+	}
+	dockerClient.TasksData = []swarm.Task{
+		{
+			ServiceID: "SERVICEID",
+			NetworksAttachments: []swarm.NetworkAttachment{
+				{
+					Network:   swarm.Network{ID: caddyNetworkID},
+					Addresses: prefixes("10.0.0.1/24"),
+				},
+			},
+			DesiredState: swarm.TaskStateRunning,
+			Status:       swarm.TaskStatus{State: swarm.TaskStateRunning},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"	reverse_proxy tasks.service:5000\n" +
+		"	reverse_proxy /vip* service:5000\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs
+
+	testGeneration(t, dockerClient, func(options *config.Options) {
+		options.ProxyServiceTasks = true
+	}, expectedCaddyfile, expectedLogs)
+}
+
+func TestServices_HostnameAliasInOverrideNetwork(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.NetworkInspectData["other-network-id"] = networkInspect("other-network-id", "other-network")
+	dockerClient.ServicesData = []swarm.Service{
+		{
+			ID: "SERVICEID",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "service",
+					Labels: map[string]string{
+						"caddy_ingress_network":      "other-network",
+						fmtLabel("%s"):               "service.testdomain.com",
+						fmtLabel("%s.reverse_proxy"): "{{upstreams (hostname \"alias\") 5000}}",
+					},
+				},
+				TaskTemplate: swarm.TaskSpec{
+					Networks: []swarm.NetworkAttachmentConfig{
+						{
+							Target:  "other-network-id",
+							Aliases: []string{"api"},
+						},
+					},
+				},
+			},
+			Endpoint: swarm.Endpoint{
+				VirtualIPs: []swarm.EndpointVirtualIP{
+					{
+						NetworkID: "other-network-id",
+					},
+				},
+			},
+		},
+	}
+
+	const expectedCaddyfile = "service.testdomain.com {\n" +
+		"	reverse_proxy api:5000\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs
+
+	testGeneration(t, dockerClient, nil, expectedCaddyfile, expectedLogs)
+}
@@ -0,0 +1,394 @@
+package generator
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/caddyfile"
+	"go.uber.org/zap"
+)
+
+const traefikLabelPrefix = "traefik."
+
+var traefikRuleTermRegex = regexp.MustCompile(`^\s*(\w+)\((.*)\)\s*$`)
+
+// traefikHTTPEntrypoints are the usual names of Traefik HTTP and HTTPS entry
+// points, served by Caddy on its HTTP and HTTPS ports
+var traefikHTTPEntrypoints = map[string]bool{
+	"web":       true,
+	"websecure": true,
+	"http":      true,
+	"https":     true,
+}
+
+// traefikIssue is a Traefik label that can't be translated into caddyfile
+type traefikIssue struct {
+	label  string
+	reason string
+}
+
+// traefikMiddleware is a Traefik middleware translated into caddyfile directives
+type traefikMiddleware struct {
+	// redirect is the target of a scheme redirect, replacing the proxy
+	redirect string
+	// redirectScheme and redirectPort are the scheme and port of the redirect
+	redirectScheme string
+	redirectPort   string
+	// redirectPermanent redirects with a permanent status code
+	redirectPermanent bool
+	// basicAuth are the users of a basic auth middleware, as "user hash" pairs
+	basicAuth []string
+	// basicAuthRealm is the realm of a basic auth middleware
+	basicAuthRealm string
+	// issue explains why the middleware can't be translated, nil when it can
+	issue *traefikIssue
+}
+
+// traefikRouter is a Traefik HTTP router
+type traefikRouter struct {
+	name    string
+	options map[string]string
+}
+
+// addTraefikCaddyfile translates the Traefik labels of a container or service,
+// merging them into its caddyfile and logging the labels that can't be translated
+func (g *CaddyfileGenerator) addTraefikCaddyfile(caddyfileBlock *caddyfile.Container, labels map[string]string, source string, getTargets targetsProvider, logger *zap.Logger) error {
+	traefikCaddyfile, issues, err := traefikLabelsToCaddyfile(labels, getTargets)
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		logger.Warn("Ignoring Traefik label that can't be translated",
+			zap.String("source", source),
+			zap.String("label", issue.label),
+			zap.String("reason", issue.reason),
+		)
+	}
+	logMergeConflicts(caddyfileBlock.Merge(traefikCaddyfile), logger)
+	return nil
+}
+
+// traefikLabelsToCaddyfile translates Traefik HTTP routers, with their rule, TLS,
+// service port and redirect or basic auth middlewares, into caddyfile sites.
+// Routers using middlewares that can't be translated are not translated.
+func traefikLabelsToCaddyfile(labels map[string]string, getTargets targetsProvider) (*caddyfile.Container, []traefikIssue, error) {
+	container := caddyfile.CreateContainer()
+	issues := []traefikIssue{}
+
+	if value, ok := labels["traefik.enable"]; ok && !isTrue.MatchString(value) {
+		return container, issues, nil
+	}
+
+	routers := map[string]map[string]string{}
+	services := map[string]map[string]string{}
+	middlewares := map[string]map[string]string{}
+	for _, label := range sortedKeys(labels) {
+		if !strings.HasPrefix(label, traefikLabelPrefix) || label == "traefik.enable" {
+			continue
+		}
+		var objects map[string]map[string]string
+		var path string
+		switch {
+		case strings.HasPrefix(label, "traefik.http.routers."):
+			objects, path = routers, strings.TrimPrefix(label, "traefik.http.routers.")
+		case strings.HasPrefix(label, "traefik.http.services."):
+			objects, path = services, strings.TrimPrefix(label, "traefik.http.services.")
+		case strings.HasPrefix(label, "traefik.http.middlewares."):
+			objects, path = middlewares, strings.TrimPrefix(label, "traefik.http.middlewares.")
+		}
+		name, option, found := strings.Cut(path, ".")
+		if objects == nil || !found {
+			issues = append(issues, traefikIssue{label, "not supported"})
+			continue
+		}
+		if objects[name] == nil {
+			objects[name] = map[string]string{}
+		}
+		objects[name][strings.ToLower(option)] = labels[label]
+	}
+
+	translatedMiddlewares := map[string]*traefikMiddleware{}
+	for _, name := range sortedKeys(middlewares) {
+		middleware, middlewareIssues := translateTraefikMiddleware(name, middlewares[name])
+		translatedMiddlewares[name] = middleware
+		issues = append(issues, middlewareIssues...)
+	}
+
+	for _, name := range sortedKeys(services) {
+		for _, option := range sortedKeys(services[name]) {
+			if option != "loadbalancer.server.port" && option != "loadbalancer.server.scheme" {
+				issues = append(issues, traefikIssue{"traefik.http.services." + name + "." + option, "not supported"})
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(routers) {
+		router := &traefikRouter{name: name, options: routers[name]}
+		block, routerIssues, err := router.translate(services, translatedMiddlewares, getTargets)
+		if err != nil {
+			return nil, nil, err
+		}
+		issues = append(issues, routerIssues...)
+		if block != nil {
+			container.AddBlock(block)
+		}
+	}
+
+	return container, issues, nil
+}
+
+func translateTraefikMiddleware(name string, options map[string]string) (*traefikMiddleware, []traefikIssue) {
+	middleware := &traefikMiddleware{}
+	issues := []traefikIssue{}
+	addIssue := func(option string, reason string) {
+		issue := traefikIssue{"traefik.http.middlewares." + name + "." + option, reason}
+		if middleware.issue == nil {
+			middleware.issue = &issue
+		}
+		issues = append(issues, issue)
+	}
+
+	scheme, port := "", ""
+	for _, option := range sortedKeys(options) {
+		value := options[option]
+		switch option {
+		case "redirectscheme.scheme":
+			scheme = value
+		case "redirectscheme.port":
+			port = value
+		case "redirectscheme.permanent":
+			middleware.redirectPermanent = isTrue.MatchString(value)
+		case "basicauth.users":
+			for _, user := range strings.Split(value, ",") {
+				username, hash, _ := strings.Cut(strings.TrimSpace(user), ":")
+				if !strings.HasPrefix(hash, "$2") {
+					addIssue(option, fmt.Sprintf("password of user %s isn't a bcrypt hash", username))
+					continue
+				}
+				middleware.basicAuth = append(middleware.basicAuth, username+" "+hash)
+			}
+		case "basicauth.realm":
+			middleware.basicAuthRealm = value
+		default:
+			addIssue(option, "not supported")
+		}
+	}
+
+	if scheme != "" {
+		middleware.redirectScheme, middleware.redirectPort = scheme, port
+		if scheme != "http" && scheme != "https" {
+			addIssue("redirectscheme.scheme", fmt.Sprintf("invalid scheme %q", scheme))
+		} else if port != "" {
+			middleware.redirect = scheme + "://{host}:" + port + "{uri}"
+		} else {
+			middleware.redirect = scheme + "://{host}{uri}"
+		}
+	}
+	return middleware, issues
+}
+
+// translate translates the router into a site, or returns nil with the issues
+// preventing it
+func (router *traefikRouter) translate(services map[string]map[string]string, middlewares map[string]*traefikMiddleware, getTargets targetsProvider) (*caddyfile.Block, []traefikIssue, error) {
+	issues := []traefikIssue{}
+	label := func(option string) string {
+		return "traefik.http.routers." + router.name + "." + option
+	}
+	skip := func(option string, reason string) (*caddyfile.Block, []traefikIssue, error) {
+		return nil, append(issues, traefikIssue{label(option), reason}), nil
+	}
+
+	for _, option := range sortedKeys(router.options) {
+		switch option {
+		case "rule", "service", "middlewares", "entrypoints", "tls", "tls.certresolver":
+		default:
+			issues = append(issues, traefikIssue{label(option), "not supported"})
+		}
+	}
+
+	for _, entrypoint := range splitTraefikList(router.options["entrypoints"]) {
+		if !traefikHTTPEntrypoints[entrypoint] {
+			return skip("entrypoints", fmt.Sprintf("entry point %s isn't an HTTP or HTTPS entry point", entrypoint))
+		}
+	}
+
+	hosts, path, err := parseTraefikRule(router.options["rule"])
+	if err != nil {
+		return skip("rule", err.Error())
+	}
+
+	// Traefik serves routers without TLS only on HTTP
+	_, hasTLS := router.options["tls.certresolver"]
+	hasTLS = hasTLS || isTrue.MatchString(router.options["tls"])
+	siteScheme, sitePort := "http", "80"
+	if hasTLS {
+		siteScheme, sitePort = "https", "443"
+	}
+
+	handle := caddyfile.CreateBlock()
+	handle.AddKeys("handle")
+	if path != "" {
+		handle.AddKeys(path)
+	}
+
+	redirect := ""
+	redirectPermanent := false
+	for _, name := range splitTraefikList(router.options["middlewares"]) {
+		name = strings.TrimSuffix(name, "@docker")
+		middleware := middlewares[name]
+		if middleware == nil {
+			return skip("middlewares", fmt.Sprintf("middleware %s isn't defined by labels", name))
+		}
+		if middleware.issue != nil {
+			return skip("middlewares", fmt.Sprintf("middleware %s can't be translated", name))
+		}
+		if middleware.redirect != "" && redirect == "" {
+			// Redirecting to the scheme of the site would loop
+			if middleware.redirectScheme == siteScheme && (middleware.redirectPort == "" || middleware.redirectPort == sitePort) {
+				issues = append(issues, traefikIssue{label("middlewares"), fmt.Sprintf("middleware %s redirects to the %s scheme of the router, ignoring it", name, siteScheme)})
+			} else {
+				redirect, redirectPermanent = middleware.redirect, middleware.redirectPermanent
+			}
+		}
+		if len(middleware.basicAuth) > 0 {
+			basicAuth := caddyfile.CreateBlock()
+			basicAuth.AddKeys("basic_auth")
+			if middleware.basicAuthRealm != "" {
+				basicAuth.AddKeys("bcrypt", middleware.basicAuthRealm)
+			}
+			for _, user := range middleware.basicAuth {
+				userBlock := caddyfile.CreateBlock()
+				userBlock.AddKeys(strings.SplitN(user, " ", 2)...)
+				basicAuth.AddBlock(userBlock)
+			}
+			handle.AddBlock(basicAuth)
+		}
+	}
+
+	if redirect != "" {
+		redir := caddyfile.CreateBlock()
+		redir.AddKeys("redir", redirect)
+		if redirectPermanent {
+			redir.AddKeys("permanent")
+		}
+		handle.AddBlock(redir)
+	} else {
+		serviceName := router.options["service"]
+		if serviceName == "" && len(services) == 1 {
+			serviceName = sortedKeys(services)[0]
+		} else if serviceName == "" {
+			serviceName = router.name
+		}
+		if _, provider, found := strings.Cut(serviceName, "@"); found && provider != "docker" {
+			return skip("service", fmt.Sprintf("service %s isn't defined by labels", serviceName))
+		}
+		serviceName = strings.TrimSuffix(serviceName, "@docker")
+		service := services[serviceName]
+
+		port := 0
+		portLabel := "traefik.http.services." + serviceName + ".loadbalancer.server.port"
+		if value, ok := service["loadbalancer.server.port"]; !ok {
+			issues = append(issues, traefikIssue{portLabel, "not set, proxying to port 80"})
+		} else if port, err = strconv.Atoi(value); err != nil {
+			return nil, append(issues, traefikIssue{portLabel, fmt.Sprintf("invalid port %q", value)}), nil
+		}
+
+		protocol := ""
+		switch scheme := service["loadbalancer.server.scheme"]; scheme {
+		case "", "http":
+		case "https", "h2c":
+			protocol = scheme + "://"
+		default:
+			return nil, append(issues, traefikIssue{"traefik.http.services." + serviceName + ".loadbalancer.server.scheme", fmt.Sprintf("invalid scheme %q", scheme)}), nil
+		}
+
+		targets, err := getTargets(upstreamsOptions{port: port})
+		if err != nil {
+			return nil, nil, err
+		}
+		sort.Strings(targets)
+		reverseProxy := caddyfile.CreateBlock()
+		reverseProxy.AddKeys("reverse_proxy")
+		for _, target := range targets {
+			reverseProxy.AddKeys(protocol + target)
+		}
+		handle.AddBlock(reverseProxy)
+	}
+
+	site := caddyfile.CreateBlock()
+	for _, host := range hosts {
+		if hasTLS {
+			site.AddKeys(host)
+		} else {
+			site.AddKeys("http://" + host)
+		}
+	}
+	site.AddBlock(handle)
+	return site, issues, nil
+}
+
+// parseTraefikRule parses router rules made of Host, Path and PathPrefix matchers,
+// returning the hosts and the caddyfile path matcher
+func parseTraefikRule(rule string) ([]string, string, error) {
+	if strings.TrimSpace(rule) == "" {
+		return nil, "", fmt.Errorf("rule is required")
+	}
+	hosts := []string{}
+	paths := []string{}
+	for _, alternative := range strings.Split(rule, "||") {
+		alternativeHosts := []string{}
+		alternativePath := ""
+		for _, term := range strings.Split(alternative, "&&") {
+			match := traefikRuleTermRegex.FindStringSubmatch(term)
+			if match == nil {
+				return nil, "", fmt.Errorf("unsupported rule expression %q", strings.TrimSpace(term))
+			}
+			args := []string{}
+			for _, arg := range splitTraefikList(match[2]) {
+				args = append(args, strings.Trim(arg, "`\""))
+			}
+			switch match[1] {
+			case "Host":
+				if len(alternativeHosts) > 0 {
+					return nil, "", fmt.Errorf("unsupported rule requiring multiple Host matchers %q", strings.TrimSpace(alternative))
+				}
+				alternativeHosts = append(alternativeHosts, args...)
+			case "Path", "PathPrefix":
+				if alternativePath != "" || len(args) != 1 || strings.ContainsAny(args[0], "{}") {
+					return nil, "", fmt.Errorf("unsupported path matcher %q", strings.TrimSpace(term))
+				}
+				alternativePath = args[0]
+				if match[1] == "PathPrefix" {
+					alternativePath += "*"
+				}
+			default:
+				return nil, "", fmt.Errorf("unsupported matcher %s", match[1])
+			}
+		}
+		if len(alternativeHosts) == 0 {
+			return nil, "", fmt.Errorf("rule without Host matcher")
+		}
+		hosts = append(hosts, alternativeHosts...)
+		paths = append(paths, alternativePath)
+	}
+	for _, path := range paths[1:] {
+		if path != paths[0] {
+			return nil, "", fmt.Errorf("alternatives with different paths")
+		}
+	}
+	return hosts, paths[0], nil
+}
+
+// splitTraefikList splits comma separated values, ignoring empty ones
+func splitTraefikList(value string) []string {
+	values := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
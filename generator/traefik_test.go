@@ -0,0 +1,152 @@
+package generator
+
+import (
+	"testing"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+	"github.com/moby/moby/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func enableTraefikLabels(options *config.Options) {
+	options.TraefikLabels = true
+}
+
+func TestTraefik_RoutersServicesAndMiddlewares(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		createContainer("web", "172.17.0.2", map[string]string{
+			"traefik.enable":                                             "true",
+			"traefik.http.routers.web.rule":                              "Host(`example.com`) && PathPrefix(`/admin`)",
+			"traefik.http.routers.web.entrypoints":                       "websecure",
+			"traefik.http.routers.web.tls.certresolver":                  "letsencrypt",
+			"traefik.http.routers.web.middlewares":                       "auth@docker",
+			"traefik.http.routers.web-http.rule":                         "Host(`example.com`)",
+			"traefik.http.routers.web-http.entrypoints":                  "web",
+			"traefik.http.routers.web-http.middlewares":                  "to-https",
+			"traefik.http.services.web.loadbalancer.server.port":         "8080",
+			"traefik.http.middlewares.auth.basicauth.users":              "admin:$2y$05$hash",
+			"traefik.http.middlewares.auth.basicauth.realm":              "Admin",
+			"traefik.http.middlewares.to-https.redirectscheme.scheme":    "https",
+			"traefik.http.middlewares.to-https.redirectscheme.permanent": "true",
+			fmtLabel("%s"):        "example.com",
+			fmtLabel("%s.encode"): "gzip",
+		}),
+	}
+
+	const expectedCaddyfile = "example.com {\n" +
+		"	encode gzip\n" +
+		"	handle /admin* {\n" +
+		"		basic_auth bcrypt Admin {\n" +
+		"			admin $2y$05$hash\n" +
+		"		}\n" +
+		"		reverse_proxy 172.17.0.2:8080\n" +
+		"	}\n" +
+		"}\n" +
+		"http://example.com {\n" +
+		"	handle {\n" +
+		"		redir https://{host}{uri} permanent\n" +
+		"	}\n" +
+		"}\n"
+
+	testGeneration(t, dockerClient, enableTraefikLabels, expectedCaddyfile, commonLogs)
+}
+
+func TestTraefik_ReportsLabelsThatCantBeTranslated(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		createContainer("web", "172.17.0.2", map[string]string{
+			"traefik.docker.network":                           "caddy-network",
+			"traefik.http.routers.api.rule":                    "Host(`api.example.com`)",
+			"traefik.http.routers.api.middlewares":             "sso",
+			"traefik.http.routers.regexp.rule":                 "HostRegexp(`{sub:[a-z]+}.example.com`)",
+			"traefik.http.routers.web.rule":                    "Host(`web.example.com`)",
+			"traefik.http.routers.web.priority":                "10",
+			"traefik.http.middlewares.sso.forwardauth.address": "http://sso",
+		}),
+	}
+
+	const expectedCaddyfile = "http://web.example.com {\n" +
+		"	handle {\n" +
+		"		reverse_proxy 172.17.0.2\n" +
+		"	}\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Ignoring Traefik label that can't be translated	{"source": "container web", "label": "traefik.docker.network", "reason": "not supported"}` + newLine +
+		`WARN	Ignoring Traefik label that can't be translated	{"source": "container web", "label": "traefik.http.middlewares.sso.forwardauth.address", "reason": "not supported"}` + newLine +
+		`WARN	Ignoring Traefik label that can't be translated	{"source": "container web", "label": "traefik.http.routers.api.middlewares", "reason": "middleware sso can't be translated"}` + newLine +
+		`WARN	Ignoring Traefik label that can't be translated	{"source": "container web", "label": "traefik.http.routers.regexp.rule", "reason": "unsupported matcher HostRegexp"}` + newLine +
+		`WARN	Ignoring Traefik label that can't be translated	{"source": "container web", "label": "traefik.http.routers.web.priority", "reason": "not supported"}` + newLine +
+		`WARN	Ignoring Traefik label that can't be translated	{"source": "container web", "label": "traefik.http.services.web.loadbalancer.server.port", "reason": "not set, proxying to port 80"}` + newLine
+
+	testGeneration(t, dockerClient, enableTraefikLabels, expectedCaddyfile, expectedLogs)
+}
+
+func TestTraefik_SkipsRoutersThatCantBeServed(t *testing.T) {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		createContainer("web", "172.17.0.2", map[string]string{
+			"traefik.http.routers.dashboard.rule":                        "Host(`traefik.example.com`)",
+			"traefik.http.routers.dashboard.service":                     "api@internal",
+			"traefik.http.routers.metrics.rule":                          "Host(`metrics.example.com`)",
+			"traefik.http.routers.metrics.entrypoints":                   "metrics",
+			"traefik.http.routers.web.rule":                              "Host(`example.com`)",
+			"traefik.http.routers.web.entrypoints":                       "web,websecure",
+			"traefik.http.routers.web.tls":                               "true",
+			"traefik.http.routers.web.middlewares":                       "to-https",
+			"traefik.http.services.web.loadbalancer.server.port":         "8080",
+			"traefik.http.middlewares.to-https.redirectscheme.scheme":    "https",
+			"traefik.http.middlewares.to-https.redirectscheme.permanent": "true",
+		}),
+	}
+
+	const expectedCaddyfile = "example.com {\n" +
+		"	handle {\n" +
+		"		reverse_proxy 172.17.0.2:8080\n" +
+		"	}\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Ignoring Traefik label that can't be translated	{"source": "container web", "label": "traefik.http.routers.dashboard.service", "reason": "service api@internal isn't defined by labels"}` + newLine +
+		`WARN	Ignoring Traefik label that can't be translated	{"source": "container web", "label": "traefik.http.routers.metrics.entrypoints", "reason": "entry point metrics isn't an HTTP or HTTPS entry point"}` + newLine +
+		`WARN	Ignoring Traefik label that can't be translated	{"source": "container web", "label": "traefik.http.routers.web.middlewares", "reason": "middleware to-https redirects to the https scheme of the router, ignoring it"}` + newLine
+
+	testGeneration(t, dockerClient, enableTraefikLabels, expectedCaddyfile, expectedLogs)
+}
+
+func TestTraefik_DisabledOrNotEnabled(t *testing.T) {
+	labels := map[string]string{
+		"traefik.http.routers.web.rule":                      "Host(`example.com`)",
+		"traefik.http.services.web.loadbalancer.server.port": "8080",
+	}
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = []container.Summary{
+		createContainer("web", "172.17.0.2", labels),
+	}
+
+	testGeneration(t, dockerClient, nil, "# Empty caddyfile", commonLogs)
+
+	labels["traefik.enable"] = "false"
+	testGeneration(t, dockerClient, enableTraefikLabels, "# Empty caddyfile", commonLogs)
+}
+
+func TestParseTraefikRule(t *testing.T) {
+	hosts, path, err := parseTraefikRule("Host(`a.com`, `b.com`) && Path(`/x`) || Host(`c.com`) && Path(`/x`)")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.com", "b.com", "c.com"}, hosts)
+	assert.Equal(t, "/x", path)
+
+	_, _, err = parseTraefikRule("PathPrefix(`/api`)")
+	assert.EqualError(t, err, "rule without Host matcher")
+
+	_, _, err = parseTraefikRule("Host(`a.com`) && PathPrefix(`/a`) || Host(`b.com`)")
+	assert.EqualError(t, err, "alternatives with different paths")
+
+	_, _, err = parseTraefikRule("Host(`a.com`) && Host(`b.com`)")
+	assert.EqualError(t, err, "unsupported rule requiring multiple Host matchers \"Host(`a.com`) && Host(`b.com`)\"")
+
+	_, _, err = parseTraefikRule("Host(`a.com`) && !PathPrefix(`/a`)")
+	assert.EqualError(t, err, "unsupported rule expression \"!PathPrefix(`/a`)\"")
+}
@@ -0,0 +1,129 @@
+package generator
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/caddyfile"
+	"github.com/moby/moby/api/types/container"
+	"go.uber.org/zap"
+)
+
+// Environment variables of the nginx-proxy conventions
+const (
+	virtualHostEnv     = "VIRTUAL_HOST"
+	virtualPortEnv     = "VIRTUAL_PORT"
+	virtualPathEnv     = "VIRTUAL_PATH"
+	letsencryptHostEnv = "LETSENCRYPT_HOST"
+)
+
+const defaultVirtualPort = 80
+
+// addVirtualHostCaddyfile synthesizes sites from the nginx-proxy environment
+// variables of a container, merging them into its caddyfile
+func (g *CaddyfileGenerator) addVirtualHostCaddyfile(clientIndex int, caddyfileBlock *caddyfile.Container, container *container.Summary, logger *zap.Logger) error {
+	env, err := g.getContainerEnv(clientIndex, container)
+	if err != nil {
+		logger.Error("Failed to inspect container environment", zap.String("container", containerName(container)), zap.Error(err))
+		return nil
+	}
+
+	hosts := []string{}
+	for _, host := range strings.Split(env[virtualHostEnv], ",") {
+		host = strings.TrimSpace(host)
+		if strings.HasPrefix(host, "~") {
+			logger.Warn("Ignoring regular expression virtual host", zap.String("container", containerName(container)), zap.String("host", host))
+			continue
+		}
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	port := getVirtualPort(container)
+	if value, ok := env[virtualPortEnv]; ok {
+		if port, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+			logger.Warn("Ignoring container with invalid "+virtualPortEnv, zap.String("container", containerName(container)), zap.String("port", value))
+			return nil
+		}
+	}
+
+	ips, err := g.getContainerIPAddresses(container, logger, true)
+	if err != nil {
+		return err
+	}
+
+	letsencryptHosts := map[string]bool{}
+	for _, host := range strings.Split(env[letsencryptHostEnv], ",") {
+		letsencryptHosts[strings.TrimSpace(host)] = true
+	}
+
+	virtualHostCaddyfile := caddyfile.CreateContainer()
+	for _, host := range hosts {
+		reverseProxy := caddyfile.CreateBlock()
+		reverseProxy.AddKeys("reverse_proxy")
+		if path := strings.TrimSpace(env[virtualPathEnv]); path != "" && path != "/" {
+			reverseProxy.AddKeys(path + "*")
+		}
+		reverseProxy.AddKeys(withPort(ips, port)...)
+
+		// nginx-proxy serves hosts without a certificate only on HTTP
+		site := caddyfile.CreateBlock()
+		if letsencryptHosts[host] {
+			site.AddKeys(host)
+		} else {
+			site.AddKeys("http://" + host)
+		}
+		site.AddBlock(reverseProxy)
+		virtualHostCaddyfile.AddBlock(site)
+	}
+	logMergeConflicts(caddyfileBlock.Merge(virtualHostCaddyfile), logger)
+	return nil
+}
+
+// getVirtualPort returns the port nginx-proxy proxies to when VIRTUAL_PORT isn't
+// set: the port exposed by the container when it exposes only one, otherwise 80
+func getVirtualPort(container *container.Summary) int {
+	ports := map[uint16]bool{}
+	for _, portSummary := range container.Ports {
+		if portSummary.Type == "" || portSummary.Type == "tcp" {
+			ports[portSummary.PrivatePort] = true
+		}
+	}
+	if len(ports) == 1 {
+		for port := range ports {
+			return int(port)
+		}
+	}
+	return defaultVirtualPort
+}
+
+// getContainerEnv returns the environment variables of a container. They are
+// inspected once per container, as they never change, and kept while the
+// container is listed.
+func (g *CaddyfileGenerator) getContainerEnv(clientIndex int, container *container.Summary) (map[string]string, error) {
+	env, ok := g.containerEnvs[container.ID]
+	if !ok {
+		env, ok = g.previousContainerEnvs[container.ID]
+	}
+	if !ok {
+		g.countAPICall("ContainerInspect")
+		inspect, err := g.dockerClients[clientIndex].ContainerInspect(context.Background(), container.ID)
+		if err != nil {
+			return nil, err
+		}
+		env = map[string]string{}
+		if inspect.Config != nil {
+			for _, variable := range inspect.Config.Env {
+				name, value, _ := strings.Cut(variable, "=")
+				env[name] = value
+			}
+		}
+	}
+	g.containerEnvs[container.ID] = env
+	return env, nil
+}
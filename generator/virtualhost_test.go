@@ -0,0 +1,109 @@
+package generator
+
+import (
+	"testing"
+
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/docker"
+	"github.com/moby/moby/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func enableNginxProxyEnv(options *config.Options) {
+	options.NginxProxyEnv = true
+}
+
+func virtualHostDockerClient(envs map[string][]string, containers ...container.Summary) *docker.ClientMock {
+	dockerClient := createBasicDockerClientMock()
+	dockerClient.ContainersData = containers
+	for id, env := range envs {
+		dockerClient.ContainerInspectData[id] = container.InspectResponse{
+			Config: &container.Config{Env: env},
+		}
+	}
+	return dockerClient
+}
+
+func TestVirtualHost_SynthesizesSites(t *testing.T) {
+	web1 := createContainer("web-1", "172.17.0.2", map[string]string{})
+	web1.Ports = []container.PortSummary{{PrivatePort: 3000, Type: "tcp"}}
+	web2 := createContainer("web-2", "172.17.0.3", map[string]string{})
+	web2.Ports = []container.PortSummary{{PrivatePort: 3000, Type: "tcp"}}
+	api := createContainer("api", "172.17.0.4", map[string]string{
+		fmtLabel("%s"):        "example.com",
+		fmtLabel("%s.encode"): "gzip",
+	})
+
+	dockerClient := virtualHostDockerClient(map[string][]string{
+		"web-1": {"VIRTUAL_HOST=example.com,www.example.com", "LETSENCRYPT_HOST=example.com"},
+		"web-2": {"VIRTUAL_HOST=example.com,www.example.com", "LETSENCRYPT_HOST=example.com"},
+		"api":   {"VIRTUAL_HOST=example.com", "VIRTUAL_PORT=8080", "VIRTUAL_PATH=/api/", "LETSENCRYPT_HOST=example.com"},
+	}, web1, web2, api)
+
+	const expectedCaddyfile = "example.com {\n" +
+		"	encode gzip\n" +
+		"	reverse_proxy /api/* 172.17.0.4:8080\n" +
+		"	reverse_proxy 172.17.0.2:3000 172.17.0.3:3000\n" +
+		"}\n" +
+		"http://www.example.com {\n" +
+		"	reverse_proxy 172.17.0.2:3000 172.17.0.3:3000\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`INFO	Site address conflict, merging sites	{"address": "example.com", "policy": "merge", "sources": ["container api", "container web-1", "container web-2"]}` + newLine +
+		`INFO	Site address conflict, merging sites	{"address": "www.example.com", "policy": "merge", "sources": ["container web-1", "container web-2"]}` + newLine
+
+	testGeneration(t, dockerClient, enableNginxProxyEnv, expectedCaddyfile, expectedLogs)
+}
+
+func TestVirtualHost_IgnoresInvalidEnv(t *testing.T) {
+	dockerClient := virtualHostDockerClient(map[string][]string{
+		"port":   {"VIRTUAL_HOST=port.example.com", "VIRTUAL_PORT=http"},
+		"regexp": {"VIRTUAL_HOST=~^app\\..*$,app.example.com"},
+		"none":   {"PATH=/usr/bin"},
+	},
+		createContainer("port", "172.17.0.2", map[string]string{}),
+		createContainer("regexp", "172.17.0.3", map[string]string{}),
+		createContainer("none", "172.17.0.4", map[string]string{}),
+	)
+
+	const expectedCaddyfile = "http://app.example.com {\n" +
+		"	reverse_proxy 172.17.0.3:80\n" +
+		"}\n"
+
+	const expectedLogs = commonLogs +
+		`WARN	Ignoring container with invalid VIRTUAL_PORT	{"container": "port", "port": "http"}` + newLine +
+		`WARN	Ignoring regular expression virtual host	{"container": "regexp", "host": "~^app\\..*$"}` + newLine
+
+	testGeneration(t, dockerClient, enableNginxProxyEnv, expectedCaddyfile, expectedLogs)
+}
+
+func TestVirtualHost_Disabled(t *testing.T) {
+	dockerClient := virtualHostDockerClient(map[string][]string{
+		"web": {"VIRTUAL_HOST=example.com"},
+	}, createContainer("web", "172.17.0.2", map[string]string{}))
+
+	testGeneration(t, dockerClient, nil, "# Empty caddyfile", commonLogs)
+}
+
+func TestVirtualHost_InspectsContainersOnce(t *testing.T) {
+	dockerClient := virtualHostDockerClient(map[string][]string{
+		"web": {"VIRTUAL_HOST=example.com"},
+	}, createContainer("web", "172.17.0.2", map[string]string{}))
+
+	options := &config.Options{
+		LabelPrefix:   DefaultLabelPrefix,
+		NginxProxyEnv: true,
+	}
+	generator := CreateGenerator([]docker.Client{dockerClient}, createDockerUtilsMock(), options)
+
+	logger := zap.NewNop()
+	generator.GenerateCaddyfile(logger)
+	// The caddy container is also inspected to find ingress networks
+	assert.Equal(t, 2, generator.APICalls()["ContainerInspect"])
+
+	caddyfile, _ := generator.GenerateCaddyfile(logger)
+	assert.Equal(t, 0, generator.APICalls()["ContainerInspect"])
+	assert.Equal(t, "http://example.com {\n\treverse_proxy 172.17.0.2:80\n}\n", string(caddyfile))
+}
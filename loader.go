@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"path/filepath"
 	"sync"
 	"time"
@@ -14,6 +15,7 @@ import (
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/joho/godotenv"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/caddyfile"
 	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
 	"github.com/lucaslorentz/caddy-docker-proxy/v2/docker"
 	"github.com/lucaslorentz/caddy-docker-proxy/v2/generator"
@@ -37,6 +39,7 @@ type DockerLoader struct {
 	lastJSONConfig  []byte
 	lastVersion     int64
 	serversVersions *utils.StringInt64CMap
+	serversConfigs  *utils.StringBytesCMap
 	serversUpdating *utils.StringBoolCMap
 	caddyLogging    *caddy.Logging
 }
@@ -46,6 +49,7 @@ func CreateDockerLoader(options *config.Options) *DockerLoader {
 	return &DockerLoader{
 		options:         options,
 		serversVersions: utils.NewStringInt64CMap(),
+		serversConfigs:  utils.NewStringBytesCMap(),
 		serversUpdating: utils.NewStringBoolCMap(),
 		caddyLogging:    buildCaddyLoggingConfig(options),
 	}
@@ -132,11 +136,19 @@ func (dockerLoader *DockerLoader) Start() error {
 	dockerLoader.dockerClients = dockerClients
 	dockerLoader.skipEvents = make([]bool, len(dockerLoader.dockerClients))
 
+	caddyfile.RegisterSingleDirectives(dockerLoader.options.SingleDirectives...)
+	for directive, strategy := range dockerLoader.options.MergeStrategies {
+		if err := caddyfile.RegisterMergeStrategy(directive, caddyfile.MergeStrategy(strategy)); err != nil {
+			log.Error("Ignoring invalid merge strategy", zap.String("directive", directive), zap.Error(err))
+		}
+	}
+
 	dockerLoader.generator = generator.CreateGenerator(
 		dockerClients,
 		docker.CreateUtils(),
 		dockerLoader.options,
 	)
+	upstreamsIndex.Store(dockerLoader.generator.UpstreamsIndex())
 
 	log.Info(
 		"Start",
@@ -145,15 +157,36 @@ func (dockerLoader *DockerLoader) Start() error {
 		zap.String("LabelPrefix", dockerLoader.options.LabelPrefix),
 		zap.Duration("PollingInterval", dockerLoader.options.PollingInterval),
 		zap.Bool("ProxyServiceTasks", dockerLoader.options.ProxyServiceTasks),
+		zap.String("UpstreamsMode", string(dockerLoader.options.UpstreamsMode)),
+		zap.String("UpstreamsIPFamily", string(dockerLoader.options.UpstreamsIPFamily)),
 		zap.Bool("ProcessCaddyfile", dockerLoader.options.ProcessCaddyfile),
+		zap.Bool("CaddyfileSourceComments", dockerLoader.options.CaddyfileSourceComments),
 		zap.Bool("ScanStoppedContainers", dockerLoader.options.ScanStoppedContainers),
 		zap.String("IngressNetworks", fmt.Sprintf("%v", dockerLoader.options.IngressNetworks)),
+		zap.String("IngressNetworksLabel", dockerLoader.options.IngressNetworksLabel),
+		zap.Bool("AutoAttachNetworks", dockerLoader.options.AutoAttachNetworks),
+		zap.Bool("CreateIngressNetwork", dockerLoader.options.CreateIngressNetwork),
+		zap.String("SiteConflictPolicy", string(dockerLoader.options.SiteConflictPolicy)),
+		zap.String("LabelsPolicyPath", dockerLoader.options.LabelsPolicyPath),
+		zap.String("RulesPath", dockerLoader.options.RulesPath),
+		zap.Any("MergeStrategies", caddyfile.MergeStrategies()),
+		zap.Bool("TraefikLabels", dockerLoader.options.TraefikLabels),
+		zap.Bool("NginxProxyEnv", dockerLoader.options.NginxProxyEnv),
 		zap.Strings("DockerSockets", dockerLoader.options.DockerSockets),
 		zap.Strings("DockerCertsPath", dockerLoader.options.DockerCertsPath),
 		zap.Strings("DockerAPIsVersion", dockerLoader.options.DockerAPIsVersion),
+		zap.Strings("DockerHostsAddress", dockerLoader.options.DockerHostsAddress),
 		zap.String("CaddyfileAutosavePath", CaddyfileAutosavePath),
 	)
 
+	if dockerLoader.options.AutoAttachNetworks && dockerLoader.generator.PrimaryIngressNetwork() == "" {
+		log.Warn("AutoAttachNetworks requires ingress networks to be configured, containers and services won't be attached")
+	}
+
+	if dockerLoader.options.CreateIngressNetwork {
+		dockerLoader.generator.CreateIngressNetwork(log)
+	}
+
 	ready := make(chan struct{})
 	dockerLoader.timer = time.AfterFunc(0, func() {
 		<-ready
@@ -166,14 +199,22 @@ func (dockerLoader *DockerLoader) Start() error {
 	return nil
 }
 
+// monitorEvents listens to the events of each docker client in its own
+// goroutine, so a client blocking on its event stream doesn't keep the others
+// from being listened to
 func (dockerLoader *DockerLoader) monitorEvents() {
-	for {
-		dockerLoader.listenEvents()
-		time.Sleep(30 * time.Second)
+	for i := range dockerLoader.dockerClients {
+		go func(i int) {
+			for {
+				dockerLoader.listenEvents(i)
+				time.Sleep(30 * time.Second)
+			}
+		}(i)
 	}
 }
 
-func (dockerLoader *DockerLoader) listenEvents() {
+func (dockerLoader *DockerLoader) listenEvents(i int) {
+	dockerClient := dockerLoader.dockerClients[i]
 	args := make(client.Filters)
 	if !isTrue.MatchString(os.Getenv("CADDY_DOCKER_NO_SCOPE")) {
 		// This env var is useful for Podman where in some instances the scope can cause some issues.
@@ -185,48 +226,51 @@ func (dockerLoader *DockerLoader) listenEvents() {
 	args.Add("type", "config")
 	args.Add("type", "network")
 
-	for i, dockerClient := range dockerLoader.dockerClients {
-		context, cancel := context.WithCancel(context.Background())
-
-		eventsChan, errorChan := dockerClient.Events(context, client.EventsListOptions{
-			Filters: args,
-		})
-
-		log := logger()
-		log.Info("Connecting to docker events", zap.String("DockerSocket", dockerLoader.options.DockerSockets[i]))
-
-	ListenEvents:
-		for {
-			select {
-			case event := <-eventsChan:
-				if dockerLoader.skipEvents[i] {
-					continue
-				}
-
-				update := (event.Type == "container" && event.Action == "create") ||
-					(event.Type == "container" && event.Action == "start") ||
-					(event.Type == "container" && event.Action == "stop") ||
-					(event.Type == "container" && event.Action == "die") ||
-					(event.Type == "container" && event.Action == "destroy") ||
-					(event.Type == "service" && event.Action == "create") ||
-					(event.Type == "service" && event.Action == "update") ||
-					(event.Type == "service" && event.Action == "remove") ||
-					(event.Type == "config" && event.Action == "create") ||
-					(event.Type == "config" && event.Action == "remove") ||
-					(event.Type == "network" && event.Action == "connect") ||
-					(event.Type == "network" && event.Action == "disconnect")
-
-				if update {
-					dockerLoader.skipEvents[i] = true
-					dockerLoader.timer.Reset(dockerLoader.options.EventThrottleInterval)
-				}
-			case err := <-errorChan:
-				cancel()
-				if err != nil {
-					log.Error("Docker events error", zap.Error(err))
-				}
-				break ListenEvents
+	context, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eventsChan, errorChan := dockerClient.Events(context, client.EventsListOptions{
+		Filters: args,
+	})
+
+	log := logger()
+	log.Info("Connecting to docker events", zap.String("DockerSocket", dockerLoader.options.DockerSockets[i]))
+
+	// Network events may have been missed while disconnected
+	dockerLoader.generator.InvalidateNetworks(i)
+
+	for {
+		select {
+		case event := <-eventsChan:
+			// Cached network metadata must be invalidated even when updates are throttled
+			dockerLoader.generator.HandleNetworkEvent(i, event)
+
+			if dockerLoader.skipEvents[i] {
+				continue
+			}
+
+			update := (event.Type == "container" && event.Action == "create") ||
+				(event.Type == "container" && event.Action == "start") ||
+				(event.Type == "container" && event.Action == "stop") ||
+				(event.Type == "container" && event.Action == "die") ||
+				(event.Type == "container" && event.Action == "destroy") ||
+				(event.Type == "service" && event.Action == "create") ||
+				(event.Type == "service" && event.Action == "update") ||
+				(event.Type == "service" && event.Action == "remove") ||
+				(event.Type == "config" && event.Action == "create") ||
+				(event.Type == "config" && event.Action == "remove") ||
+				(event.Type == "network" && event.Action == "connect") ||
+				(event.Type == "network" && event.Action == "disconnect")
+
+			if update {
+				dockerLoader.skipEvents[i] = true
+				dockerLoader.timer.Reset(dockerLoader.options.EventThrottleInterval)
 			}
+		case err := <-errorChan:
+			if err != nil {
+				log.Error("Docker events error", zap.Error(err))
+			}
+			return
 		}
 	}
 }
@@ -272,6 +316,12 @@ func (dockerLoader *DockerLoader) update() bool {
 
 		log.Debug("New Config JSON", zap.ByteString("json", configJSON))
 
+		// Servers keep their current config when the new one fails provisioning
+		if module, err := validateConfig(configJSON); err != nil {
+			log.Error("Invalid configuration", zap.String("module", module), zap.Error(err))
+			return false
+		}
+
 		dockerLoader.lastJSONConfig = configJSON
 		dockerLoader.lastVersion++
 	}
@@ -325,11 +375,11 @@ func (dockerLoader *DockerLoader) updateServer(wg *sync.WaitGroup, server string
 		return
 	}
 
-	// The local target loads in-process; remote targets POST to the admin API.
+	// The local target loads in-process; remote targets go through the admin API.
 	if server == localServer {
 		err = pushLocal(postBody)
 	} else {
-		err = pushRemoteAdmin(server, postBody)
+		err = dockerLoader.pushRemote(server, postBody)
 	}
 	if err != nil {
 		log.Error("Failed to send configuration to", zap.String("server", server), zap.Error(err))
@@ -341,6 +391,34 @@ func (dockerLoader *DockerLoader) updateServer(wg *sync.WaitGroup, server string
 	log.Info("Successfully configured", zap.String("server", server))
 }
 
+// pushRemote applies the changes since the last config sent to a remote server
+// with a targeted admin API request, and falls back to loading the whole config
+// when the changes can't be patched safely or patching fails.
+func (dockerLoader *DockerLoader) pushRemote(server string, postBody []byte) error {
+	log := logger()
+
+	patch, err := diffConfig(dockerLoader.serversConfigs.Get(server), postBody)
+	if err != nil {
+		log.Debug("Loading whole configuration", zap.String("server", server), zap.String("reason", err.Error()))
+		err = pushRemoteAdmin(server, postBody)
+	} else if patch == nil {
+		log.Debug("Configuration unchanged", zap.String("server", server))
+	} else if err = patchRemoteAdmin(server, *patch); err != nil {
+		log.Warn("Failed to patch configuration, loading whole configuration", zap.String("server", server), zap.Error(err))
+		err = pushRemoteAdmin(server, postBody)
+	} else {
+		log.Debug("Patched configuration", zap.String("server", server), zap.String("path", patch.Path))
+	}
+	if err != nil {
+		// The server config is unknown, the next update loads it whole
+		dockerLoader.serversConfigs.Delete(server)
+		return err
+	}
+
+	dockerLoader.serversConfigs.Set(server, postBody)
+	return nil
+}
+
 // prepareServerConfig builds the config to push to server from the loader's last
 // generated config, with a single unmarshal/marshal round-trip.
 func (dockerLoader *DockerLoader) prepareServerConfig(server string) ([]byte, error) {
@@ -382,5 +460,5 @@ func getServerAdminListen(options *config.Options, server string) string {
 	if options.AdminListen != "" {
 		return options.AdminListen
 	}
-	return "tcp/" + server + ":2019"
+	return "tcp/" + net.JoinHostPort(server, "2019")
 }
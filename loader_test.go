@@ -2,10 +2,19 @@ package caddydockerproxy
 
 import (
 	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/lucaslorentz/caddy-docker-proxy/v2/config"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/docker"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/generator"
+	"github.com/moby/moby/api/types/events"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -154,3 +163,96 @@ func TestPrepareServerConfig(t *testing.T) {
 		assert.Equal(t, "WARN", unmarshalConfig(t, out).Logging.Logs["default"].Level)
 	})
 }
+
+func TestValidateConfig(t *testing.T) {
+	module, err := validateConfig([]byte(`{"apps":{"http":{"servers":{"srv0":{"listen":[":0"],"routes":[{"handle":[{"handler":"static_response"}]}]}}}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "", module)
+
+	module, err = validateConfig([]byte(`{"apps":{"http":{"servers":{"srv0":{"listen":[":0"],"routes":[{"match":[{"path_regexp":{"pattern":"("}}],"handle":[{"handler":"static_response"}]}]}}}}}`))
+	assert.Error(t, err)
+	assert.Equal(t, "http.matchers.path_regexp", module)
+
+	module, err = validateConfig([]byte(`{"apps":{"http":{"servers":{"srv0":{"listen":[":0"],"routes":[{"handle":[{"handler":"unknown"}]}]}}}}}`))
+	assert.Error(t, err)
+	assert.Equal(t, "http.handlers.unknown", module)
+
+	// Certificate files and log outputs may only exist on the servers hosts
+	logFile := filepath.Join(t.TempDir(), "logs", "access.log")
+	module, err = validateConfig([]byte(`{"logging":{"logs":{"default":{"writer":{"output":"file","filename":"` + logFile + `"}}}},"apps":{"tls":{"certificates":{"load_files":[{"certificate":"/missing/cert.pem","key":"/missing/key.pem"}]}}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "", module)
+	assert.NoFileExists(t, logFile)
+}
+
+func TestMonitorEvents_ListensToEachClient(t *testing.T) {
+	// The first client never sends events nor errors
+	blockedClient := &docker.ClientMock{}
+	eventsClient := &docker.ClientMock{EventsChannel: make(chan events.Message, 1)}
+	dockerClients := []docker.Client{blockedClient, eventsClient}
+
+	options := &config.Options{
+		DockerSockets:         []string{"blocked", "events"},
+		EventThrottleInterval: time.Hour,
+	}
+	dockerLoader := &DockerLoader{
+		options:       options,
+		dockerClients: dockerClients,
+		generator:     generator.CreateGenerator(dockerClients, &docker.UtilsMock{}, options),
+		timer:         time.AfterFunc(time.Hour, func() {}),
+		skipEvents:    make([]bool, len(dockerClients)),
+	}
+	defer dockerLoader.timer.Stop()
+
+	dockerLoader.monitorEvents()
+	eventsClient.EventsChannel <- events.Message{Type: events.ContainerEventType, Action: events.ActionStart}
+
+	assert.Eventually(t, func() bool {
+		return dockerLoader.skipEvents[1]
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPushRemote(t *testing.T) {
+	var requests []string
+	failPatches := false
+	adminServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		if failPatches && r.URL.Path != "/load" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer adminServer.Close()
+
+	adminURL, err := url.Parse(adminServer.URL)
+	require.NoError(t, err)
+	defer func(port string) { remoteAdminPort = port }(remoteAdminPort)
+	remoteAdminPort = adminURL.Port()
+	server := adminURL.Hostname()
+
+	dockerLoader := CreateDockerLoader(&config.Options{})
+	first := `{"apps":{"http":{"servers":{"srv0":{"routes":[{"handle":[{"handler":"static_response","body":"a"}]},{"handle":[{"handler":"static_response","body":"b"}]}]}}}}}`
+	second := `{"apps":{"http":{"servers":{"srv0":{"routes":[{"handle":[{"handler":"static_response","body":"c"}]},{"handle":[{"handler":"static_response","body":"d"}]}]}}}}}`
+	third := `{"apps":{"http":{"servers":{"srv0":{"routes":[{"handle":[{"handler":"static_response","body":"e"}]},{"handle":[{"handler":"static_response","body":"d"}]}]}}}}}`
+
+	// The first config is loaded whole
+	require.NoError(t, dockerLoader.pushRemote(server, []byte(first)))
+	assert.Equal(t, []string{"POST /load " + first}, requests)
+
+	// Several changes are sent as one request at their common parent
+	requests = nil
+	require.NoError(t, dockerLoader.pushRemote(server, []byte(second)))
+	assert.Equal(t, []string{
+		`PATCH /config/apps/http/servers/srv0/routes [{"handle":[{"body":"c","handler":"static_response"}]},{"handle":[{"body":"d","handler":"static_response"}]}]`,
+	}, requests)
+
+	// A failing patch falls back to loading the whole config
+	requests = nil
+	failPatches = true
+	require.NoError(t, dockerLoader.pushRemote(server, []byte(third)))
+	assert.Equal(t, []string{
+		`PATCH /config/apps/http/servers/srv0/routes/0/handle/0/body "e"`,
+		"POST /load " + third,
+	}, requests)
+	assert.Equal(t, []byte(third), dockerLoader.serversConfigs.Get(server))
+}
@@ -116,3 +116,36 @@ func TestIntegration_LocalPushEnablesAdmin(t *testing.T) {
 		return resp.StatusCode == http.StatusOK
 	}, 5*time.Second, 50*time.Millisecond, "local load must keep the admin API enabled")
 }
+
+// A config that adapts but fails provisioning must not replace the running one,
+// and its version isn't recorded so it's retried with the next generated config.
+func TestIntegration_LocalPushSkipsInvalidConfig(t *testing.T) {
+	appPort := runLocalPush(t, &config.Options{AdminDisabled: true})
+
+	caddyfile := fmt.Sprintf(":%d {\n\t@bad path_regexp (\n\trespond @bad \"invalid\"\n}\n", appPort)
+	configJSON, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(caddyfile), nil)
+	require.NoError(t, err)
+
+	loader := &DockerLoader{
+		options:         &config.Options{AdminDisabled: true},
+		lastJSONConfig:  configJSON,
+		lastVersion:     2,
+		serversVersions: utils.NewStringInt64CMap(),
+		serversUpdating: utils.NewStringBoolCMap(),
+	}
+	loader.serversVersions.Set(localServer, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	loader.updateServer(&wg, localServer)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), loader.serversVersions.Get(localServer))
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", appPort))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "docker-proxy-local-load", string(body))
+}
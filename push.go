@@ -2,13 +2,70 @@ package caddydockerproxy
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"regexp"
 
 	"github.com/caddyserver/caddy/v2"
 )
 
+// failingModuleRegexp matches the modules named in Caddy provisioning errors,
+// the last match being the innermost one
+var failingModuleRegexp = regexp.MustCompile(`(?:provision|unknown module:) ([\w.]+)`)
+
+// validateConfig provisions the config without starting it, catching what the
+// caddyfile adapter accepts but Caddy would reject on load, like a bad regexp or
+// a missing module. It returns the ID of the failing module when known.
+func validateConfig(postBody []byte) (module string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic validating config: %v", r)
+		}
+	}()
+
+	config := &caddy.Config{}
+	if err := json.Unmarshal(postBody, config); err != nil {
+		return "", err
+	}
+	if err := withoutHostFiles(config); err != nil {
+		return "", err
+	}
+
+	if err := caddy.Validate(config); err != nil {
+		if matches := failingModuleRegexp.FindAllStringSubmatch(err.Error(), -1); len(matches) > 0 {
+			module = matches[len(matches)-1][1]
+		}
+		return module, err
+	}
+	return "", nil
+}
+
+// withoutHostFiles removes from config the certificate files and log outputs,
+// which exist on the hosts of the servers and not necessarily where the config
+// is validated.
+func withoutHostFiles(config *caddy.Config) error {
+	config.Logging = nil
+
+	tlsRaw, ok := config.AppsRaw["tls"]
+	if !ok {
+		return nil
+	}
+	var tlsApp map[string]interface{}
+	if err := json.Unmarshal(tlsRaw, &tlsApp); err != nil {
+		return err
+	}
+	if certificates, ok := tlsApp["certificates"].(map[string]interface{}); ok {
+		delete(certificates, "load_files")
+		delete(certificates, "load_folders")
+	}
+	var err error
+	config.AppsRaw["tls"], err = json.Marshal(tlsApp)
+	return err
+}
+
 // pushLocal loads the config into the in-process Caddy via caddy.Load, the same
 // function the admin /load handler calls. The loader runs in the same process
 // as the local Caddy, so this avoids looping back through the admin API over
@@ -28,13 +85,33 @@ func pushLocal(postBody []byte) (err error) {
 
 // pushRemoteAdmin POSTs the config to a controlled server's admin API.
 func pushRemoteAdmin(server string, postBody []byte) error {
-	url := "http://" + server + ":2019/load"
+	return adminRequest(server, "POST", "/load", postBody)
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(postBody))
+// patchRemoteAdmin applies a targeted config change through a controlled
+// server's admin API. Caddy applies the request atomically, so a failure leaves
+// the server with a consistent config that the caller can replace with a full
+// /load.
+func patchRemoteAdmin(server string, patch configPatch) error {
+	if err := adminRequest(server, patch.Method, patch.Path, patch.Body); err != nil {
+		return fmt.Errorf("%s %s: %w", patch.Method, patch.Path, err)
+	}
+	return nil
+}
+
+// remoteAdminPort is the port of the admin API of controlled servers
+var remoteAdminPort = "2019"
+
+func adminRequest(server string, method string, path string, body []byte) error {
+	url := "http://" + net.JoinHostPort(server, remoteAdminPort) + path
+
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
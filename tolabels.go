@@ -0,0 +1,102 @@
+package caddydockerproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/caddyfile"
+	"github.com/lucaslorentz/caddy-docker-proxy/v2/generator"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+func createToLabelsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "to-labels <Caddyfile>",
+		Short: "Convert a Caddyfile into docker-proxy labels",
+		Long: `
+Converts the blocks of a Caddyfile into labels generating the same Caddyfile,
+with the ordering prefixes and isolation suffixes needed to keep it unchanged.
+The labels are verified by converting them back. Comments are not converted.
+Use - to read the Caddyfile from stdin.
+`,
+		Args: cobra.ExactArgs(1),
+	}
+	cmd.Flags().String("format", "compose", "Output format: compose | flags")
+	cmd.Flags().String("label-prefix", generator.DefaultLabelPrefix, "Prefix for Docker labels")
+	cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdToLabels)
+	return cmd
+}
+
+func cmdToLabels(flags caddycmd.Flags) (int, error) {
+	var content []byte
+	var err error
+	if path := flags.Arg(0); path == "-" {
+		content, err = io.ReadAll(os.Stdin)
+	} else {
+		content, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	output, err := convertToLabels(content, flags.String("label-prefix"), flags.String("format"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	os.Stdout.Write(output)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// convertToLabels converts caddyfile content into labels formatted as a compose
+// labels section or as docker --label flags
+func convertToLabels(content []byte, labelPrefix string, format string) ([]byte, error) {
+	container, err := caddyfile.Unmarshal(content)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := caddyfile.ToLabels(container, labelPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "compose":
+		// Compose interpolates variables in labels, $$ being a literal $
+		composeLabels := make(map[string]string, len(labels))
+		for key, value := range labels {
+			composeLabels[strings.ReplaceAll(key, "$", "$$")] = strings.ReplaceAll(value, "$", "$$")
+		}
+		buffer := &bytes.Buffer{}
+		encoder := yaml.NewEncoder(buffer)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(map[string]map[string]string{"labels": composeLabels}); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case "flags":
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		flags := make([]string, 0, len(keys))
+		for _, key := range keys {
+			flags = append(flags, "--label "+shellQuote(key+"="+labels[key]))
+		}
+		return []byte(strings.Join(flags, " \\\n") + "\n"), nil
+	default:
+		return nil, fmt.Errorf("invalid format %q, expected compose or flags", format)
+	}
+}
+
+// shellQuote quotes a value for POSIX shells
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
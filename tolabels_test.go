@@ -0,0 +1,56 @@
+package caddydockerproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const toLabelsCaddyfile = `example.com {
+	respond /hello "Hello World" 200
+	reverse_proxy web:8080
+}
+`
+
+func TestConvertToLabels_Compose(t *testing.T) {
+	output, err := convertToLabels([]byte(toLabelsCaddyfile), "caddy", "compose")
+	require.NoError(t, err)
+	assert.Equal(t, "labels:\n"+
+		"  caddy: example.com\n"+
+		"  caddy.respond: /hello \"Hello World\" 200\n"+
+		"  caddy.reverse_proxy: web:8080\n", string(output))
+}
+
+func TestConvertToLabels_ComposeEscapesVariables(t *testing.T) {
+	output, err := convertToLabels([]byte("example.com {\n\trespond \"${HOME} costs $5\"\n}\n"), "caddy", "compose")
+	require.NoError(t, err)
+	assert.Equal(t, "labels:\n"+
+		"  caddy: example.com\n"+
+		"  caddy.respond: '\"$${HOME} costs $$5\"'\n", string(output))
+
+	output, err = convertToLabels([]byte("example.com {\n\trespond $5\n}\n"), "caddy", "flags")
+	require.NoError(t, err)
+	assert.Equal(t, "--label 'caddy=example.com' \\\n"+
+		"--label 'caddy.respond=$5'\n", string(output))
+}
+
+func TestConvertToLabels_Flags(t *testing.T) {
+	output, err := convertToLabels([]byte(toLabelsCaddyfile), "proxy", "flags")
+	require.NoError(t, err)
+	assert.Equal(t, "--label 'proxy=example.com' \\\n"+
+		"--label 'proxy.respond=/hello \"Hello World\" 200' \\\n"+
+		"--label 'proxy.reverse_proxy=web:8080'\n", string(output))
+}
+
+func TestConvertToLabels_Errors(t *testing.T) {
+	_, err := convertToLabels([]byte(toLabelsCaddyfile), "caddy", "json")
+	assert.EqualError(t, err, `invalid format "json", expected compose or flags`)
+
+	_, err = convertToLabels([]byte("example.com {\n}\n}"), "caddy", "compose")
+	assert.EqualError(t, err, "Unexpected token '}' at line 3, column 1")
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+}
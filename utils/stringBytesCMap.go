@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"sync"
+)
+
+// StringBytesCMap is a concurrent map implementation of map[string][]byte
+type StringBytesCMap struct {
+	mutex    sync.RWMutex
+	internal map[string][]byte
+}
+
+func NewStringBytesCMap() *StringBytesCMap {
+	return &StringBytesCMap{
+		mutex:    sync.RWMutex{},
+		internal: map[string][]byte{},
+	}
+}
+
+// Set map value
+func (m *StringBytesCMap) Set(key string, value []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.internal[key] = value
+}
+
+// Get map value or default
+func (m *StringBytesCMap) Get(key string) []byte {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.internal[key]
+}
+
+// Delete map value
+func (m *StringBytesCMap) Delete(key string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.internal, key)
+}